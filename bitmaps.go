@@ -0,0 +1,71 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// The bitmaps header extension
+type bitmapsExtension struct {
+	NbBitmaps             uint32
+	Reserved              uint32
+	BitmapDirectorySize   uint64
+	BitmapDirectoryOffset uint64
+}
+
+// A bitmap directory entry
+type bitmapDirectoryEntry struct {
+	BitmapTableOffset uint64
+	BitmapTableSize   uint32
+	Flags             uint32
+	Type              uint8
+	GranularityBits   uint8
+	NameSize          uint16
+	ExtraDataSize     uint32
+}
+
+// A persistent dirty bitmap
+type bitmap struct {
+	// Where in the file this bitmap's directory entry is
+	entryOffset int64
+	name        string
+	tableOffset int64
+	tableSize   int
+}
+
+// Read the bitmaps extension, if there is a valid one.
+func readBitmapsExtension(h header) (ext bitmapsExtension, ok bool) {
+	data := h.extension(bitmapsExtensionID)
+	if data == nil || h.autoclearFeatures()&featureBitmaps == 0 {
+		return ext, false
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &ext); err != nil {
+		exc.Throwf("Bad bitmaps extension")
+	}
+	return ext, true
+}
+
+// Read the bitmap directory
+func readBitmaps(h header, ext bitmapsExtension) []bitmap {
+	off := int64(ext.BitmapDirectoryOffset)
+	r := eio.NewReaderSection(h.io(), off, int64(ext.BitmapDirectorySize))
+	bitmaps := make([]bitmap, 0, ext.NbBitmaps)
+	for i := 0; i < int(ext.NbBitmaps); i++ {
+		pos := off + r.Position()
+		var e bitmapDirectoryEntry
+		r.ReadData(&e)
+		r.Skip(int64(e.ExtraDataSize))
+		name := r.ReadNewBuf(int(e.NameSize))
+		r.Align(8)
+		bitmaps = append(bitmaps, bitmap{
+			entryOffset: pos,
+			name:        string(name),
+			tableOffset: int64(e.BitmapTableOffset),
+			tableSize:   int(e.BitmapTableSize),
+		})
+	}
+	return bitmaps
+}
@@ -0,0 +1,228 @@
+package qcow2
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/vasi/qcow2/eio"
+)
+
+// The default size of the mapping table cache, in bytes
+const defaultCacheSize = 1 << 20
+
+// A cached cluster of metadata
+type cachedCluster struct {
+	off   int64
+	data  []byte
+	dirty bool
+}
+
+// A write-back LRU cache of metadata clusters, such as L2 tables or refcount
+// blocks.
+//
+// Dirty clusters are written when they're evicted, or when the cache is
+// flushed. A cache may depend on another one, which must be flushed before
+// any of our dirty clusters are written. Eg: an L2 table pointing at a new
+// cluster must not hit the disk before the refcount block that allocates it.
+type metadataCache struct {
+	io          *eio.BinaryIO
+	clusterSize int64
+	// Maximum number of clusters to hold
+	max int
+
+	// Most recently used at the front
+	lru      *list.List
+	clusters map[int64]*list.Element
+
+	// A cache to flush before writing any of our clusters
+	dependency *metadataCache
+
+	sync.Mutex
+}
+
+// Make a cache holding up to size bytes of metadata. Zero means the default
+// size, and a negative size disables caching, so all writes go straight to
+// the file.
+func newMetadataCache(bio *eio.BinaryIO, clusterSize int, size int64) *metadataCache {
+	if size == 0 {
+		size = defaultCacheSize
+	}
+	max := 0
+	if size > 0 {
+		max = int(eio.DivCeil(size, int64(clusterSize)))
+	}
+	return &metadataCache{
+		io:          bio,
+		clusterSize: int64(clusterSize),
+		max:         max,
+		lru:         list.New(),
+		clusters:    make(map[int64]*list.Element),
+	}
+}
+
+// Flush our dependency, if there is one, so our clusters can be written.
+//
+// Must hold the lock, which is released while flushing.
+func (c *metadataCache) flushDependency() {
+	for c.dependency != nil {
+		dep := c.dependency
+		c.dependency = nil
+		c.Unlock()
+		dep.flush()
+		c.Lock()
+	}
+}
+
+// Serializes changes to dependencies, so concurrent changes can't form a cycle
+var dependencyLock sync.Mutex
+
+// Require another cache to be flushed before any of our dirty clusters are
+// written.
+func (c *metadataCache) setDependency(dep *metadataCache) {
+	dependencyLock.Lock()
+	defer dependencyLock.Unlock()
+
+	// Don't let dependencies form a cycle, or a chain
+	dep.Lock()
+	dep.flushDependency()
+	dep.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
+	if c.dependency != nil && c.dependency != dep {
+		c.flushDependency()
+	}
+	c.dependency = dep
+}
+
+// Get the cluster containing an offset, loading it if needed.
+//
+// Returns nil if caching is disabled. Must hold the lock.
+func (c *metadataCache) cluster(off int64) *cachedCluster {
+	if c.max == 0 {
+		return nil
+	}
+
+	base := off - off%c.clusterSize
+	for {
+		if el, ok := c.clusters[base]; ok {
+			c.lru.MoveToFront(el)
+			return el.Value.(*cachedCluster)
+		}
+		if c.lru.Len() < c.max {
+			break
+		}
+
+		old := c.lru.Back().Value.(*cachedCluster)
+		if old.dirty && c.dependency != nil {
+			// This releases the lock, so start over
+			c.flushDependency()
+			continue
+		}
+		c.writeCluster(old)
+		c.lru.Remove(c.lru.Back())
+		delete(c.clusters, old.off)
+	}
+
+	cl := &cachedCluster{off: base, data: make([]byte, c.clusterSize)}
+	c.io.ReadAt(base, cl.data)
+	c.clusters[base] = c.lru.PushFront(cl)
+	return cl
+}
+
+// Write a cluster to the file, if it's dirty. Must hold the lock, and have
+// flushed any dependency.
+func (c *metadataCache) writeCluster(cl *cachedCluster) {
+	if cl.dirty {
+		c.io.WriteAt(cl.off, cl.data)
+		cl.dirty = false
+	}
+}
+
+// Read bytes from within a cluster
+func (c *metadataCache) readAt(off int64, buf []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	cl := c.cluster(off)
+	if cl == nil {
+		c.io.ReadAt(off, buf)
+		return
+	}
+	copy(buf, cl.data[off-cl.off:])
+}
+
+// Write bytes within a cluster
+func (c *metadataCache) writeAt(off int64, buf []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	cl := c.cluster(off)
+	if cl == nil {
+		c.flushDependency()
+		c.io.WriteAt(off, buf)
+		return
+	}
+	copy(cl.data[off-cl.off:], buf)
+	cl.dirty = true
+}
+
+// Read a table entry
+func (c *metadataCache) read(off int64) uint64 {
+	buf := make([]byte, 8)
+	c.readAt(off, buf)
+	return c.io.ByteOrder().Uint64(buf)
+}
+
+// Write a table entry
+func (c *metadataCache) write(off int64, e uint64) {
+	buf := make([]byte, 8)
+	c.io.ByteOrder().PutUint64(buf, e)
+	c.writeAt(off, buf)
+}
+
+// Read a whole cluster. If it's not cached, it's read without being cached.
+func (c *metadataCache) peek(off int64, buf []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.clusters[off-off%c.clusterSize]; ok {
+		copy(buf, el.Value.(*cachedCluster).data)
+	} else {
+		c.io.ReadAt(off, buf)
+	}
+}
+
+// Forget a cluster without writing it, because its contents are being replaced
+func (c *metadataCache) forget(off int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	base := off - off%c.clusterSize
+	if el, ok := c.clusters[base]; ok {
+		c.lru.Remove(el)
+		delete(c.clusters, base)
+	}
+}
+
+// Write all dirty clusters to the file, after flushing any dependency
+func (c *metadataCache) flush() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.flushDependency()
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		c.writeCluster(el.Value.(*cachedCluster))
+	}
+}
+
+// Write all dirty clusters, and forget everything, so the metadata can be
+// modified directly
+func (c *metadataCache) invalidate() {
+	c.flush()
+
+	c.Lock()
+	defer c.Unlock()
+	c.lru.Init()
+	c.clusters = make(map[int64]*list.Element)
+}
@@ -0,0 +1,70 @@
+package qcow2
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Make an anonymous temporary file
+func tempFile(tb testing.TB) *os.File {
+	f, err := ioutil.TempFile("", "qcow2-test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	os.Remove(f.Name())
+	return f
+}
+
+// Create an image in an anonymous temporary file
+func tempImage(tb testing.TB, opts CreateOptions) Qcow2 {
+	q, err := Create(tempFile(tb), opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return q
+}
+
+func benchmarkRandomRead(b *testing.B, cacheSize int64) {
+	const size = 1 << 30
+	q := tempImage(b, CreateOptions{Size: size})
+
+	// Allocate data all over the disk, so many L2 tables are in use
+	g, err := q.Guest()
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := make([]byte, 4096)
+	rand.Read(p)
+	for off := int64(0); off < size; off += 8 << 20 {
+		if _, err := g.WriteAt(p, off); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := g.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	g, err = q.GuestWithOptions(GuestOptions{CacheSize: cacheSize})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer g.Close()
+	rnd := rand.New(rand.NewSource(1))
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.ReadAt(p, rnd.Int63n(size/4096)*4096); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRandomReadNoCache(b *testing.B) {
+	benchmarkRandomRead(b, -1)
+}
+
+func BenchmarkRandomReadCache(b *testing.B) {
+	benchmarkRandomRead(b, 0)
+}
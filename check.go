@@ -0,0 +1,305 @@
+package qcow2
+
+import "fmt"
+
+// ProblemKind categorizes a problem found by Check
+type ProblemKind int
+
+const (
+	// LeakedCluster is a cluster whose refcount is higher than the number of
+	// references to it.
+	LeakedCluster ProblemKind = iota
+	// RefcountError is a cluster whose refcount is lower than the number of
+	// references to it. Writing to the image could lose data.
+	RefcountError
+	// InvalidEntry is a table entry with reserved bits set.
+	InvalidEntry
+	// MisalignedEntry is a table entry that refers to an unaligned offset.
+	MisalignedEntry
+	// OutOfBounds is a reference to data past the end of the file.
+	OutOfBounds
+	// CopiedFlagError is a table entry whose COPIED flag doesn't match its refcount.
+	CopiedFlagError
+)
+
+var problemKindNames = map[ProblemKind]string{
+	LeakedCluster:   "leaked cluster",
+	RefcountError:   "refcount error",
+	InvalidEntry:    "invalid entry",
+	MisalignedEntry: "misaligned entry",
+	OutOfBounds:     "out of bounds",
+	CopiedFlagError: "COPIED flag error",
+}
+
+func (k ProblemKind) String() string {
+	return problemKindNames[k]
+}
+
+// A Problem is a single inconsistency found by Check
+type Problem struct {
+	Kind ProblemKind
+	// The host cluster index this problem concerns
+	Cluster int64
+	// The position in the file of the table entry with the problem, or zero
+	Entry int64
+	// The kind of structure that is referred to, eg: "L2 table"
+	Structure string
+	// For refcount problems, the refcount found and the number of references
+	Refcount   uint64
+	References uint64
+}
+
+func (p Problem) String() string {
+	switch p.Kind {
+	case LeakedCluster, RefcountError:
+		return fmt.Sprintf("%s: cluster %d has refcount %d, but %d references",
+			p.Kind, p.Cluster, p.Refcount, p.References)
+	case CopiedFlagError:
+		return fmt.Sprintf("%s: entry at offset %#x refers to %s in cluster %d with refcount %d",
+			p.Kind, p.Entry, p.Structure, p.Cluster, p.Refcount)
+	}
+	if p.Entry == 0 {
+		return fmt.Sprintf("%s: %s in cluster %d", p.Kind, p.Structure, p.Cluster)
+	}
+	return fmt.Sprintf("%s: entry at offset %#x refers to %s in cluster %d", p.Kind,
+		p.Entry, p.Structure, p.Cluster)
+}
+
+// CheckResult is a report of the consistency of a qcow2 file
+type CheckResult struct {
+	// All the problems that were found
+	Problems []Problem
+	// How many clusters were leaked. These waste space, but are harmless.
+	Leaks int
+	// How many other problems were found. These may cause data loss.
+	Corruptions int
+	// How many clusters are referenced
+	AllocatedClusters int64
+	// The offset just past the last cluster in use
+	ImageEnd int64
+
+	// How many leaks and corruptions were repaired
+	LeaksFixed       int
+	CorruptionsFixed int
+}
+
+// Clean returns whether no problems were found
+func (r *CheckResult) Clean() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CheckResult) add(p Problem) {
+	r.Problems = append(r.Problems, p)
+	if p.Kind == LeakedCluster {
+		r.Leaks++
+	} else {
+		r.Corruptions++
+	}
+}
+
+// Checks the consistency of a qcow2 file
+type checker struct {
+	header    header
+	refcounts refcounts
+	result    *CheckResult
+
+	// The size of the file, or -1 if unknown
+	fileSize int64
+	// How many references each cluster has
+	expected []uint64
+	// The refcount of each cluster, according to the refcount structures
+	actual []uint64
+	// References whose COPIED flag must be checked
+	copied []reference
+	// References that are invalid, and were not counted
+	broken []reference
+	// References to refcount structures
+	refcountStructures []reference
+}
+
+func newChecker(h header, r refcounts) *checker {
+	return &checker{header: h, refcounts: r, result: &CheckResult{}}
+}
+
+func (c *checker) check() *CheckResult {
+	c.fileSize = -1
+	if size, ok := c.header.io().Size(); ok {
+		c.fileSize = size
+	}
+	c.expected = nil
+	c.copied = nil
+	c.broken = nil
+	c.refcountStructures = nil
+	c.result = &CheckResult{}
+
+	walkReferences(c.header, c.visit)
+	c.readRefcounts()
+	c.compareRefcounts()
+	c.checkCopied()
+	return c.result
+}
+
+func (c *checker) clusterSize() int64 {
+	return int64(c.header.clusterSize())
+}
+
+// Report a problem with a reference
+func (c *checker) problem(kind ProblemKind, ref reference) {
+	if kind != CopiedFlagError {
+		c.broken = append(c.broken, ref)
+	}
+	c.result.add(Problem{
+		Kind:      kind,
+		Cluster:   ref.offset / c.clusterSize(),
+		Entry:     ref.from,
+		Structure: ref.kind.String(),
+	})
+}
+
+// Which bits must be unset in an entry of this kind?
+func (c *checker) reservedBits(kind refKind) uint64 {
+	switch kind {
+	case refL2Table:
+		return ^l1Valid
+	case refData:
+		if c.header.version() < 3 {
+			return ^l1Valid
+		}
+		return ^(l1Valid | zeroBit)
+	case refRefcountBlock:
+		return ^tableValid
+	case refBitmapData:
+		return ^offsetMask
+	}
+	return 0
+}
+
+// Check a single reference, and count it
+func (c *checker) visit(ref reference) bool {
+	if ref.entry&c.reservedBits(ref.kind) != 0 {
+		c.problem(InvalidEntry, ref)
+		return false
+	}
+	if ref.kind != refCompressed && ref.offset%c.clusterSize() != 0 {
+		c.problem(MisalignedEntry, ref)
+		return false
+	}
+	if c.fileSize >= 0 && ref.offset+ref.size > c.fileSize {
+		c.problem(OutOfBounds, ref)
+		return false
+	}
+
+	first, last := ref.clusters(c.header.clusterSize())
+	for i := first; i <= last; i++ {
+		c.reference(i)
+	}
+
+	if ref.kind == refCompressed || (ref.active && (ref.kind == refL2Table || ref.kind == refData)) {
+		c.copied = append(c.copied, ref)
+	}
+	if ref.kind == refRefcountTable || ref.kind == refRefcountBlock {
+		c.refcountStructures = append(c.refcountStructures, ref)
+	}
+	return true
+}
+
+// Grow a slice so it can hold index idx
+func growCounts(counts []uint64, idx int64) []uint64 {
+	if idx < int64(len(counts)) {
+		return counts
+	}
+	size := 2 * int64(len(counts))
+	if size <= idx {
+		size = idx + 1
+	}
+	grown := make([]uint64, size)
+	copy(grown, counts)
+	return grown
+}
+
+// Count a reference to a cluster
+func (c *checker) reference(idx int64) {
+	c.expected = growCounts(c.expected, idx)
+	c.expected[idx]++
+}
+
+// Read all the refcounts in the file, from the valid refcount blocks
+func (c *checker) readRefcounts() {
+	c.actual = nil
+	for _, ref := range c.refcountStructures {
+		if ref.kind != refRefcountBlock {
+			continue
+		}
+
+		counts := c.refcounts.readBlock(ref.offset)
+		base := (ref.from - c.header.refcountOffset()) / 8 * int64(len(counts))
+		for i, rc := range counts {
+			if rc == 0 {
+				continue
+			}
+			idx := base + int64(i)
+			c.actual = growCounts(c.actual, idx)
+			c.actual[idx] = rc
+		}
+	}
+}
+
+// Get a count, with zero for anything beyond the end
+func countAt(counts []uint64, idx int64) uint64 {
+	if idx < int64(len(counts)) {
+		return counts[idx]
+	}
+	return 0
+}
+
+// Compare the refcounts to the references we found
+func (c *checker) compareRefcounts() {
+	max := int64(len(c.expected))
+	if int64(len(c.actual)) > max {
+		max = int64(len(c.actual))
+	}
+
+	for i := int64(0); i < max; i++ {
+		expected, actual := countAt(c.expected, i), countAt(c.actual, i)
+		if expected > 0 {
+			c.result.AllocatedClusters++
+		}
+		if expected > 0 || actual > 0 {
+			c.result.ImageEnd = (i + 1) * c.clusterSize()
+		}
+		if expected == actual {
+			continue
+		}
+
+		kind := RefcountError
+		if actual > expected {
+			kind = LeakedCluster
+		}
+		c.result.add(Problem{Kind: kind, Cluster: i, Refcount: actual, References: expected})
+	}
+}
+
+// Should this reference have the COPIED flag set?
+func (c *checker) wantCopied(ref reference) bool {
+	if ref.kind == refCompressed {
+		return false // Never allowed
+	}
+	return countAt(c.actual, ref.offset/c.clusterSize()) == 1
+}
+
+// Make sure the COPIED flags are correct
+func (c *checker) checkCopied() {
+	for _, ref := range c.copied {
+		idx := ref.offset / c.clusterSize()
+		rc := countAt(c.actual, idx)
+		if c.wantCopied(ref) != (ref.entry&noCow != 0) {
+			c.result.add(Problem{
+				Kind:      CopiedFlagError,
+				Cluster:   idx,
+				Entry:     ref.from,
+				Structure: ref.kind.String(),
+				Refcount:  rc,
+			})
+		}
+	}
+}
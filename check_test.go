@@ -0,0 +1,113 @@
+package qcow2
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Make a small image with some data, and find the L1 and L2 entries for its
+// first guest cluster
+func checkImage(tb testing.TB) (q Qcow2, data []byte, l1Entry int64, l2Entry int64) {
+	q = tempImage(tb, CreateOptions{Size: 1 << 20, ClusterBits: 12})
+	data = fillGuest(tb, q, 8<<10, 1)
+	h := q.(*qcow2).header
+	l1Entry = h.l1Offset()
+	l2Entry = int64(h.io().ReadUint64(l1Entry) & offsetMask)
+	return
+}
+
+// Check a file, expecting a single problem of the given kind
+func requireProblem(tb testing.TB, q Qcow2, kind ProblemKind, cluster int64) {
+	before := fileContents(tb, q)
+	res, err := q.Check(CheckOnly)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	found := false
+	for _, p := range res.Problems {
+		if p.Kind == kind && p.Cluster == cluster {
+			found = true
+		}
+	}
+	if !found {
+		tb.Fatalf("No %s in cluster %d: %v", kind, cluster, res.Problems)
+	}
+	if kind == LeakedCluster && (res.Leaks != 1 || res.Corruptions != 0) {
+		tb.Fatalf("%+v", res)
+	}
+	if kind != LeakedCluster && res.Corruptions == 0 {
+		tb.Fatalf("%+v", res)
+	}
+	if !bytes.Equal(before, fileContents(tb, q)) {
+		tb.Fatal("Checking changed the file")
+	}
+}
+
+func TestCheckClean(t *testing.T) {
+	q, _, _, _ := checkImage(t)
+	res, err := q.Check(CheckOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() || res.Leaks != 0 || res.Corruptions != 0 {
+		t.Fatal(res.Problems)
+	}
+
+	// Header, L1, refcount table and block, L2 and two data clusters
+	if res.AllocatedClusters != 7 {
+		t.Fatalf("Allocated %d clusters", res.AllocatedClusters)
+	}
+	if size, _ := q.(*qcow2).header.io().Size(); res.ImageEnd != size {
+		t.Fatalf("Image end %d, file size %d", res.ImageEnd, size)
+	}
+}
+
+func TestCheckRefcounts(t *testing.T) {
+	q, _, _, l2Entry := checkImage(t)
+	h := q.(*qcow2).header
+	cs := int64(h.clusterSize())
+	data := int64(h.io().ReadUint64(l2Entry)&offsetMask) / cs
+
+	// An extra reference to the header is a leak
+	r := q.(*qcow2).refcounts()
+	r.set(0, 2)
+	r.close()
+	requireProblem(t, q, LeakedCluster, 0)
+
+	// A missing reference to data is a corruption
+	r = q.(*qcow2).refcounts()
+	r.set(0, 1)
+	r.set(data, 0)
+	r.close()
+	requireProblem(t, q, RefcountError, data)
+}
+
+func TestCheckEntries(t *testing.T) {
+	for _, tc := range []struct {
+		kind    ProblemKind
+		l1      bool
+		corrupt func(e uint64, cs uint64) uint64
+	}{
+		{InvalidEntry, false, func(e, cs uint64) uint64 { return e | 1<<2 }},
+		{MisalignedEntry, false, func(e, cs uint64) uint64 { return e + cs/2 }},
+		{OutOfBounds, false, func(e, cs uint64) uint64 { return noCow | 1<<40 }},
+		{CopiedFlagError, true, func(e, cs uint64) uint64 { return e &^ noCow }},
+	} {
+		t.Run(tc.kind.String(), func(t *testing.T) {
+			q, _, l1Entry, l2Entry := checkImage(t)
+			h := q.(*qcow2).header
+			entry := l2Entry
+			if tc.l1 {
+				entry = l1Entry
+			}
+			e := h.io().ReadUint64(entry)
+			cluster := int64(e&offsetMask) / int64(h.clusterSize())
+			e = tc.corrupt(e, uint64(h.clusterSize()))
+			h.io().WriteUint64(entry, e)
+			if tc.kind == OutOfBounds {
+				cluster = int64(e&offsetMask) / int64(h.clusterSize())
+			}
+			requireProblem(t, q, tc.kind, cluster)
+		})
+	}
+}
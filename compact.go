@@ -0,0 +1,358 @@
+package qcow2
+
+import (
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// ProgressFunc is called during long operations, with the amount of work done
+// so far and the total amount of work expected.
+type ProgressFunc func(done int64, total int64)
+
+// A structure that must be moved as a unit
+type compactUnit struct {
+	kind  refKind
+	start int64 // The first cluster
+	count int64 // How many clusters
+	// The references to this unit
+	refs []*reference
+	// Whether this unit can't be moved
+	pinned bool
+}
+
+// Moves clusters from the end of a qcow2 file into free space
+type compactor struct {
+	header    header
+	refcounts refcounts
+	progress  ProgressFunc
+
+	// The unit occupying each cluster
+	owner []*compactUnit
+	// References held within each cluster
+	children map[int64][]*reference
+	// Which refcount table entries have refcount blocks
+	hasBlock []bool
+
+	// The lowest cluster that could be free
+	firstFree int64
+	// Progress tracking
+	done, total int64
+}
+
+func newCompactor(h header, r refcounts, progress ProgressFunc) *compactor {
+	return &compactor{header: h, refcounts: r, progress: progress}
+}
+
+func (c *compactor) clusterSize() int64 {
+	return int64(c.header.clusterSize())
+}
+
+// How many refcounts are in a refcount block
+func (c *compactor) blockEntries() int64 {
+	return c.clusterSize() * 8 / int64(c.header.refcountBits())
+}
+
+// Find all the units in the file
+func (c *compactor) scan() {
+	c.owner = nil
+	c.children = make(map[int64][]*reference)
+	c.hasBlock = nil
+	walkReferences(c.header, c.visit)
+}
+
+func (c *compactor) visit(r reference) bool {
+	ref := &r
+	first, last := ref.clusters(c.header.clusterSize())
+	if int64(len(c.owner)) <= last {
+		owner := make([]*compactUnit, 2*last+1)
+		copy(owner, c.owner)
+		c.owner = owner
+	}
+
+	u := c.owner[first]
+	if u == nil || u.start != first {
+		u = &compactUnit{kind: ref.kind, start: first, count: last - first + 1}
+		u.pinned = !c.movable(ref)
+		for i := first; i <= last; i++ {
+			if c.owner[i] != nil {
+				// Overlapping structures, can't move them
+				c.owner[i].pinned = true
+				u.pinned = true
+			}
+			c.owner[i] = u
+		}
+	}
+	if !c.movable(ref) {
+		u.pinned = true
+	}
+
+	// Don't track the same reference twice, eg: from a shared L2 table
+	for _, other := range u.refs {
+		if other.from == ref.from {
+			return true
+		}
+	}
+	u.refs = append(u.refs, ref)
+
+	if ref.from != 0 {
+		fromIdx := ref.from / c.clusterSize()
+		c.children[fromIdx] = append(c.children[fromIdx], ref)
+	}
+	if ref.kind == refRefcountBlock {
+		ti := (ref.from - c.header.refcountOffset()) / 8
+		for int64(len(c.hasBlock)) <= ti {
+			c.hasBlock = append(c.hasBlock, false)
+		}
+		c.hasBlock[ti] = true
+	}
+	return true
+}
+
+// Can the structure referenced be moved?
+func (c *compactor) movable(ref *reference) bool {
+	switch ref.kind {
+	case refHeader, refCompressed, refBitmapDirectory:
+		return false
+	case refL1Table, refRefcountTable, refSnapshotTable:
+		return true
+	}
+	return ref.from != 0
+}
+
+// Is a cluster in use?
+func (c *compactor) used(idx int64) bool {
+	return idx < int64(len(c.owner)) && c.owner[idx] != nil
+}
+
+// How many clusters are used, up to the last one in use
+func (c *compactor) end() int64 {
+	end := int64(len(c.owner))
+	for end > 0 && c.owner[end-1] == nil {
+		end--
+	}
+	return end
+}
+
+// Can a free cluster hold data? It must have a refcount block.
+func (c *compactor) usable(idx int64) bool {
+	ti := idx / c.blockEntries()
+	return ti < int64(len(c.hasBlock)) && c.hasBlock[ti] && !c.used(idx)
+}
+
+// Find the first sequence of n usable clusters, before a limit.
+//
+// Returns -1 if there is none.
+func (c *compactor) findHole(n int64, limit int64) int64 {
+	for c.firstFree < limit && !c.usable(c.firstFree) {
+		c.firstFree++
+	}
+
+	start, count := int64(-1), int64(0)
+	for i := c.firstFree; i+n-count <= limit; i++ {
+		if !c.usable(i) {
+			count = 0
+			continue
+		}
+		if count == 0 {
+			start = i
+		}
+		count++
+		if count == n {
+			return start
+		}
+	}
+	return -1
+}
+
+// Point a reference at a new offset
+func (c *compactor) repoint(ref *reference, off int64) {
+	if ref.from == 0 {
+		switch ref.kind {
+		case refL1Table:
+			c.header.setL1Offset(off)
+		case refRefcountTable:
+			c.header.setRefcountTable(off, c.header.refcountClusters())
+		case refSnapshotTable:
+			c.header.setSnapshotsOffset(off)
+		default:
+			exc.Throwf("Can't move %s", ref.kind)
+		}
+	} else {
+		mask := offsetMask
+		switch ref.kind {
+		case refRefcountBlock:
+			mask = tableValid
+		case refL1Table, refBitmapTable:
+			mask = ^uint64(0)
+		}
+		entry := c.header.io().ReadUint64(ref.from)
+		c.header.io().WriteUint64(ref.from, entry&^mask|uint64(off))
+	}
+	ref.offset = off
+}
+
+// Move a unit to a new position
+func (c *compactor) move(u *compactUnit, dst int64) {
+	cs := c.clusterSize()
+	src := u.start
+	refcountStructure := u.kind == refRefcountBlock || u.kind == refRefcountTable
+	if refcountStructure {
+		// Make sure we copy the latest refcounts
+		c.refcounts.invalidate()
+	}
+	c.header.io().Copy(dst*cs, src*cs, int(u.count*cs))
+
+	// Reference the new clusters, and repoint all references. Refcount blocks
+	// must be repointed first, in case they contain their own refcounts.
+	if u.kind == refRefcountBlock {
+		for _, ref := range u.refs {
+			c.repoint(ref, dst*cs)
+		}
+	}
+	if refcountStructure {
+		// The cache still knows the old locations
+		c.refcounts.invalidate()
+	}
+	for i := int64(0); i < u.count; i++ {
+		c.refcounts.set(dst+i, c.refcounts.refcount(src+i))
+	}
+	if u.kind != refRefcountBlock {
+		for _, ref := range u.refs {
+			c.repoint(ref, dst*cs)
+		}
+	}
+
+	// Free the old clusters
+	for i := int64(0); i < u.count; i++ {
+		c.refcounts.set(src+i, 0)
+	}
+
+	// Update our bookkeeping
+	delta := (dst - src) * cs
+	for i := int64(0); i < u.count; i++ {
+		children := c.children[src+i]
+		for _, ch := range children {
+			ch.from += delta
+		}
+		delete(c.children, src+i)
+		if children != nil {
+			c.children[dst+i] = children
+		}
+		c.owner[src+i] = nil
+	}
+	for i := int64(0); i < u.count; i++ {
+		c.owner[dst+i] = u
+	}
+	u.start = dst
+
+	c.done += u.count
+	if c.progress != nil {
+		c.progress(c.done, c.total)
+	}
+}
+
+// Move as many units as possible from the end of the file into free space.
+//
+// Returns whether anything moved.
+func (c *compactor) compactPass() bool {
+	moved := false
+	c.firstFree = 0
+	for top := c.end() - 1; top > 0; top-- {
+		u := c.owner[top]
+		if u == nil {
+			continue
+		}
+		top = u.start
+		if u.pinned {
+			continue
+		}
+
+		dst := c.findHole(u.count, u.start)
+		if dst < 0 {
+			if u.count == 1 {
+				break // No more holes at all
+			}
+			continue
+		}
+		c.move(u, dst)
+		moved = true
+	}
+	return moved
+}
+
+// Remove refcount blocks that only describe clusters past the end of the file,
+// and shrink the refcount table to match.
+//
+// Returns whether anything changed.
+func (c *compactor) shrinkRefcounts() bool {
+	cs := c.clusterSize()
+	changed := false
+	tableOff := c.header.refcountOffset()
+	end := c.end()
+	for ti := int64(len(c.hasBlock)) - 1; ti >= 0 && ti*c.blockEntries() >= end; ti-- {
+		if !c.hasBlock[ti] {
+			continue
+		}
+		from := tableOff + ti*8
+		block := int64(c.header.io().ReadUint64(from) & tableValid)
+		c.refcounts.invalidate()
+		c.header.io().WriteUint64(from, 0)
+		c.refcounts.set(block/cs, 0)
+		c.owner[block/cs] = nil
+		c.hasBlock[ti] = false
+		changed = true
+	}
+
+	// Shrink the table
+	last := int64(len(c.hasBlock)) - 1
+	for last >= 0 && !c.hasBlock[last] {
+		last--
+	}
+	needed := eio.DivCeil((last+1)*8, cs)
+	if needed < 1 {
+		needed = 1
+	}
+	old := int64(c.header.refcountClusters())
+	if needed < old {
+		c.header.setRefcountTable(tableOff, int(needed))
+		start := tableOff / cs
+		for i := needed; i < old; i++ {
+			c.refcounts.set(start+i, 0)
+			c.owner[start+i] = nil
+		}
+		c.owner[start].count = needed
+		changed = true
+	}
+	return changed
+}
+
+// Compact the file
+func (c *compactor) compact() {
+	c.scan()
+
+	// Estimate how much work there is
+	used := int64(0)
+	for _, u := range c.owner {
+		if u != nil {
+			used++
+		}
+	}
+	for i := used; i < int64(len(c.owner)); i++ {
+		if c.owner[i] != nil {
+			c.total++
+		}
+	}
+
+	for {
+		moved := c.compactPass()
+		if !c.shrinkRefcounts() && !moved {
+			break
+		}
+	}
+
+	c.refcounts.flush()
+	c.header.io().Truncate(c.end() * c.clusterSize())
+	if c.progress != nil {
+		c.progress(c.total, c.total)
+	}
+}
@@ -0,0 +1,82 @@
+package qcow2
+
+import "testing"
+
+// Discard every nth guest cluster, and zero it in the expected data
+func discardEvery(tb testing.TB, q Qcow2, data []byte, n int) {
+	g, err := q.Guest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cs := q.(*qcow2).header.clusterSize()
+	for off := 0; off < len(data); off += n * cs {
+		if err := g.Discard(int64(off), int64(cs)); err != nil {
+			tb.Fatal(err)
+		}
+		copy(data[off:off+cs], make([]byte, cs))
+	}
+	if err := g.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	q := tempImage(t, CreateOptions{Size: 8 << 20, ClusterBits: 12})
+	data := fillGuest(t, q, 4<<20, 1)
+	discardEvery(t, q, data, 2)
+	bio := q.(*qcow2).header.io()
+	before, _ := bio.Size()
+
+	var done, total int64
+	err := q.Compact(func(d, t int64) {
+		done, total = d, t
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total == 0 || done != total {
+		t.Fatalf("Progress ended at %d of %d", done, total)
+	}
+
+	// Half the data clusters are gone
+	after, _ := bio.Size()
+	if after > before-int64(len(data))/2+(64<<10) {
+		t.Fatalf("File only shrank from %d to %d", before, after)
+	}
+	res, err := q.Check(CheckOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() || res.ImageEnd != after {
+		t.Fatalf("%+v", res)
+	}
+	verifyGuest(t, q, data)
+}
+
+func TestCompactUnfragmented(t *testing.T) {
+	q := tempImage(t, CreateOptions{Size: 4 << 20, ClusterBits: 12})
+	data := fillGuest(t, q, 1<<20, 1)
+	before := fileContents(t, q)
+
+	// Nothing to move, so nothing changes
+	if err := q.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	if after := fileContents(t, q); len(after) != len(before) {
+		t.Fatalf("File size changed from %d to %d", len(before), len(after))
+	}
+	requireClean(t, q)
+	verifyGuest(t, q, data)
+}
+
+func TestCompactWithGuest(t *testing.T) {
+	q := tempImage(t, CreateOptions{Size: 1 << 20})
+	g, err := q.Guest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if err := q.Compact(nil); err == nil {
+		t.Fatal("Compacted while a guest was open")
+	}
+}
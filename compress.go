@@ -0,0 +1,112 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	"github.com/timtadh/data-structures/exc"
+)
+
+// Compress a cluster with raw deflate, as qemu does.
+//
+// Returns nil if compression doesn't save any space.
+func compressCluster(p []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	exc.ThrowOnError(err)
+	_, err = w.Write(p)
+	exc.ThrowOnError(err)
+	exc.ThrowOnError(w.Close())
+
+	if buf.Len() >= len(p) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Decompress a cluster
+func decompressCluster(z []byte, clusterSize int) []byte {
+	r := flate.NewReader(bytes.NewReader(z))
+	defer r.Close()
+
+	p := make([]byte, clusterSize)
+	if _, err := io.ReadFull(r, p); err != nil {
+		exc.Throwf("Corrupt compressed cluster: %v", err)
+	}
+	return p
+}
+
+// Read the data of a compressed cluster, given its L2 entry
+func (g *guestImpl) readCompressed(e mapEntry) []byte {
+	bits := g.header.clusterBits()
+	off := e.compressedOffset(bits)
+	size := e.compressedSize(bits)
+
+	// The last sector may be cut short by the end of the file
+	if fileSize, ok := g.io().Size(); ok && off+size > fileSize {
+		size = fileSize - off
+	}
+	if size <= 0 {
+		exc.Throwf("Compressed cluster past end of file")
+	}
+
+	z := make([]byte, size)
+	g.io().ReadAt(off, z)
+	return decompressCluster(z, g.clusterSize())
+}
+
+// Find space for n bytes of compressed data. Compressed data is packed
+// together, so many compressed clusters can share a host cluster.
+func (g *guestImpl) allocCompressed(n int64) int64 {
+	g.compressedLock.Lock()
+	defer g.compressedLock.Unlock()
+
+	cs := int64(g.clusterSize())
+	if g.compressedNext%cs != 0 {
+		remain := cs - g.compressedNext%cs
+		if remain >= n {
+			// Fits in the current cluster
+			off := g.compressedNext
+			g.refcounts.increment(off / cs)
+			g.compressedNext += n
+			return off
+		}
+
+		// Try to continue into the next cluster
+		idx := g.refcounts.allocate(1, g.options.Allocation)
+		g.io().Zero(idx*cs, int(cs))
+		if idx*cs == g.compressedNext+remain {
+			off := g.compressedNext
+			g.refcounts.increment(off / cs)
+			g.compressedNext += n
+			return off
+		}
+		g.compressedNext = idx*cs + n
+		return idx * cs
+	}
+
+	idx := g.refcounts.allocate(1, g.options.Allocation)
+	g.io().Zero(idx*cs, int(cs))
+	g.compressedNext = idx*cs + n
+	return idx * cs
+}
+
+// Write a whole cluster in compressed form, given its compressed data
+func (g *guestImpl) writeCompressed(idx int64, z []byte) {
+	if int64(len(z)) >= int64(g.clusterSize()) {
+		exc.Throwf("Compressed data too large")
+	}
+
+	lock := g.rangeLock(idx)
+	lock.Lock()
+	defer lock.Unlock()
+
+	g.beginWrite()
+
+	off := g.allocCompressed(int64(len(z)))
+	g.io().WriteAt(off, z)
+	entry := compressedEntry(off, int64(len(z)), g.header.clusterBits())
+	g.tables.setDependency(g.refcounts.blockCache())
+	g.freeEntry(g.setL2(idx, entry))
+}
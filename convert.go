@@ -0,0 +1,284 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// ConvertFormat is the format of the output of Convert
+type ConvertFormat int
+
+const (
+	// ConvertQcow2 writes a new qcow2 file
+	ConvertQcow2 ConvertFormat = iota
+	// ConvertRaw writes a sparse raw disk image. It can also write into other
+	// writable disks, such as a new VMDK image.
+	ConvertRaw
+)
+
+// ConvertOptions control how Convert works
+type ConvertOptions struct {
+	Format ConvertFormat
+	// Options for a new qcow2 file. The size is taken from the source.
+	Create CreateOptions
+	// Compress the clusters of a new qcow2 file
+	Compress bool
+	// How many goroutines read and compress data. Defaults to GOMAXPROCS.
+	Workers int
+	// Called as data is written
+	Progress ProgressFunc
+}
+
+// How much data to handle at once, for raw output
+const rawChunkSize = 64 * 1024
+
+// A piece of the source, on its way to the destination
+type convertChunk struct {
+	off int64
+	// The data, or nil if it's all zero
+	data []byte
+	// The compressed data, or nil if it's not compressed
+	compressed []byte
+	// Closed once the data is read
+	ready chan struct{}
+}
+
+// The destination of a conversion
+type convertTarget interface {
+	// How much data should be in each chunk
+	chunkSize() int64
+	// Write a chunk
+	write(c *convertChunk)
+	// Finish writing
+	close()
+}
+
+// Copies data from a source disk into a target
+type converter struct {
+	src    io.ReaderAt
+	size   int64
+	target convertTarget
+	opts   ConvertOptions
+}
+
+// Get the size of a source disk
+func sourceSize(src io.ReaderAt) int64 {
+	switch s := src.(type) {
+	case interface {
+		Size() int64
+	}:
+		return s.Size()
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		fi, err := s.Stat()
+		exc.ThrowOnError(err)
+		return fi.Size()
+	}
+	exc.Throwf("Can't determine the size of the source")
+	return 0
+}
+
+// Find the chunks that may hold data, in order. Each one is sent both to the
+// workers, and to the writer.
+func (c *converter) chunks(pipe *eio.Pipeline, work chan<- *convertChunk,
+	ordered chan<- *convertChunk) {
+	defer close(work)
+	defer close(ordered)
+
+	cs := c.target.chunkSize()
+	send := func(idx int64) bool {
+		ch := &convertChunk{off: idx * cs, ready: make(chan struct{})}
+		for _, dst := range []chan<- *convertChunk{ordered, work} {
+			select {
+			case <-pipe.Done():
+				return false
+			case dst <- ch:
+			}
+		}
+		return true
+	}
+
+	mapper, ok := c.src.(interface {
+		Map(off int64, length int64) ([]Extent, error)
+	})
+	if !ok {
+		// No mapping, must read everything
+		for idx := int64(0); idx*cs < c.size; idx++ {
+			if !send(idx) {
+				return
+			}
+		}
+		return
+	}
+
+	exts, err := mapper.Map(0, c.size)
+	exc.ThrowOnError(err)
+	next := int64(0)
+	for _, e := range exts {
+		if !e.Data {
+			continue
+		}
+		idx := e.Start / cs
+		if idx < next {
+			idx = next
+		}
+		for ; idx*cs < e.Start+e.Length; idx++ {
+			if !send(idx) {
+				return
+			}
+		}
+		next = idx
+	}
+}
+
+// Read chunks, and compress them if needed
+func (c *converter) work(work <-chan *convertChunk) {
+	cs := c.target.chunkSize()
+	for ch := range work {
+		n := cs
+		if ch.off+n > c.size {
+			n = c.size - ch.off
+		}
+		buf := make([]byte, n)
+		if _, err := c.src.ReadAt(buf, ch.off); err != nil && err != io.EOF {
+			exc.ThrowOnError(err)
+		}
+
+		if !eio.IsZero(buf) {
+			ch.data = buf
+			if c.opts.Compress {
+				// Compress whole clusters, even at the end of the disk
+				full := make([]byte, cs)
+				copy(full, buf)
+				ch.compressed = compressCluster(full)
+			}
+		}
+		close(ch.ready)
+	}
+}
+
+// Do the conversion
+func (c *converter) convert() {
+	workers := c.opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	pipe := eio.NewPipeline()
+	defer pipe.Stop()
+
+	work := make(chan *convertChunk)
+	ordered := make(chan *convertChunk, 2*workers)
+	pipe.Go(func() {
+		c.chunks(pipe, work, ordered)
+	})
+	for i := 0; i < workers; i++ {
+		pipe.Go(func() {
+			c.work(work)
+		})
+	}
+
+	// Write in order, so the destination is laid out like the source
+	for ch := range ordered {
+		select {
+		case <-pipe.Done():
+			pipe.WaitThrow()
+		case <-ch.ready:
+		}
+		if ch.data != nil {
+			c.target.write(ch)
+		}
+		if c.opts.Progress != nil {
+			c.opts.Progress(ch.off, c.size)
+		}
+	}
+	pipe.WaitThrow()
+
+	c.target.close()
+	if c.opts.Progress != nil {
+		c.opts.Progress(c.size, c.size)
+	}
+}
+
+// Writes a new qcow2 file
+type qcow2Target struct {
+	guest *guestImpl
+}
+
+func (t *qcow2Target) chunkSize() int64 {
+	return int64(t.guest.clusterSize())
+}
+
+func (t *qcow2Target) write(c *convertChunk) {
+	if c.compressed != nil {
+		t.guest.writeCompressed(c.off/t.chunkSize(), c.compressed)
+	} else {
+		t.guest.perL2(c.data, c.off, (*guestImpl).writeRange)
+	}
+}
+
+// Close the guest and its file, so the file is synced and marked clean
+func (t *qcow2Target) close() {
+	exc.ThrowOnError(t.guest.Close())
+	exc.ThrowOnError(t.guest.owner.Close())
+}
+
+// Writes a sparse raw file
+type rawTarget struct {
+	io   *eio.BinaryIO
+	size int64
+	// The end of the data written so far
+	end int64
+}
+
+func (t *rawTarget) chunkSize() int64 {
+	return rawChunkSize
+}
+
+func (t *rawTarget) write(c *convertChunk) {
+	t.io.WriteAt(c.off, c.data)
+	t.end = c.off + int64(len(c.data))
+}
+
+// Make sure the target is big enough. Targets that are already big enough,
+// like block devices, are left alone.
+func (t *rawTarget) close() {
+	if size, ok := t.io.Size(); ok && size >= t.size {
+		return
+	}
+	if !t.io.Truncate(t.size) && t.end < t.size {
+		// Extend the file by writing a final zero
+		t.io.WriteAt(t.size-1, []byte{0})
+	}
+}
+
+// Convert copies a disk to a new image in dst, which should be empty.
+//
+// The source may be a Guest, or any io.ReaderAt with a size, such as a raw
+// *os.File. Data is only written where the source is allocated and not zero.
+func Convert(src io.ReaderAt, dst eio.ReaderWriterAt, opts ConvertOptions) error {
+	return eio.BacktraceWrap(func() {
+		c := &converter{src: src, size: sourceSize(src), opts: opts}
+		switch opts.Format {
+		case ConvertQcow2:
+			co := opts.Create
+			co.Size = c.size
+			// Nothing is there yet, so there's no need to compare
+			c.target = &qcow2Target{create(dst, co).guest(GuestOptions{WriteUnchanged: true})}
+		case ConvertRaw:
+			if opts.Compress {
+				exc.Throwf("Raw images can't be compressed")
+			}
+			c.target = &rawTarget{io: eio.NewIO(dst, binary.BigEndian), size: c.size}
+		default:
+			exc.Throwf("Unknown format %d", opts.Format)
+		}
+		c.convert()
+	})
+}
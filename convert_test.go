@@ -0,0 +1,132 @@
+package qcow2
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/vasi/qcow2/eio"
+)
+
+func TestConvertRawPresized(t *testing.T) {
+	src := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(src[:4096])
+
+	// A target that's bigger than the source, like a block device
+	dst := tempFile(t)
+	if _, err := dst.WriteAt([]byte{0xaa}, 2<<20-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := Convert(bytes.NewReader(src), dst, ConvertOptions{Format: ConvertRaw}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 2<<20)
+	if _, err := dst.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(src)], src) {
+		t.Fatal("Converted data doesn't match")
+	}
+	if got[len(got)-1] != 0xaa {
+		t.Fatal("Data past the end of the guest was changed")
+	}
+}
+
+// Make a disk with random, compressible and zero clusters
+func convertSource(size int, cs int) []byte {
+	src := make([]byte, size)
+	rnd := rand.New(rand.NewSource(1))
+	for off := 0; off < size; off += cs {
+		switch off / cs % 3 {
+		case 0:
+			rnd.Read(src[off : off+cs])
+		case 1:
+			copy(src[off:off+cs], bytes.Repeat([]byte("compressible"), cs))
+		}
+	}
+	return src
+}
+
+func TestConvertQcow2(t *testing.T) {
+	const cs = 1 << 16
+	src := convertSource(4<<20, cs)
+	for _, compress := range []bool{false, true} {
+		dst := tempFile(t)
+		var done, total int64
+		err := Convert(bytes.NewReader(src), dst, ConvertOptions{
+			Compress: compress,
+			Workers:  3,
+			Progress: func(d, t int64) { done, total = d, t },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done != int64(len(src)) || total != int64(len(src)) {
+			t.Fatalf("Progress ended at %d of %d", done, total)
+		}
+
+		q, err := Open(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Recovery() != nil {
+			t.Fatal("Converted file was left dirty")
+		}
+		requireClean(t, q)
+		verifyGuest(t, q, src)
+
+		// Zero clusters aren't allocated, and compressible ones are compressed
+		g, err := q.Guest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exts, err := g.Map(0, g.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range exts {
+			for off := e.Start; off < e.Start+e.Length; off += cs {
+				kind := off / cs % 3
+				if e.Data != (kind != 2) || e.Compressed != (compress && kind == 1) {
+					t.Fatalf("Compress %t, cluster %d: %+v", compress, off/cs, e)
+				}
+			}
+		}
+		g.Close()
+		q.Close()
+	}
+}
+
+func TestConvertQcow2ToRaw(t *testing.T) {
+	q := tempImage(t, CreateOptions{Size: 3 << 20, ClusterBits: 12})
+	data := fillGuest(t, q, 1<<20, 1)
+	g, err := q.Guest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	dst := tempFile(t)
+	if err := Convert(g, dst, ConvertOptions{Format: ConvertRaw}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := dst.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != g.Size() {
+		t.Fatalf("Raw file has size %d", fi.Size())
+	}
+	got := make([]byte, g.Size())
+	if _, err := dst.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(data)], data) || !eio.IsZero(got[len(data):]) {
+		t.Fatal("Converted data doesn't match")
+	}
+
+	if err := Convert(g, tempFile(t), ConvertOptions{Format: ConvertRaw, Compress: true}); err == nil {
+		t.Fatal("Compressed a raw image")
+	}
+}
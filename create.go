@@ -0,0 +1,125 @@
+package qcow2
+
+import (
+	"encoding/binary"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// CreateOptions describe a new qcow2 file
+type CreateOptions struct {
+	// The size of the guest disk, in bytes
+	Size int64
+	// The format version, 2 or 3. Defaults to 3.
+	Version int
+	// Log2 of the cluster size. Defaults to 16, for 64 KB clusters.
+	ClusterBits int
+	// How many bits in each refcount, a power of two. Defaults to 16, which is
+	// the only value allowed for version 2.
+	RefcountBits int
+	// How much space to allocate for the guest disk up front. Defaults to
+	// none. Only used at creation.
+	Preallocation Preallocation
+}
+
+const (
+	defaultVersion      = 3
+	defaultClusterBits  = 16
+	defaultRefcountBits = 16
+
+	v3Length uint32 = 104
+)
+
+// Fill in defaults, and validate
+func (o *CreateOptions) validate() {
+	if o.Version == 0 {
+		o.Version = defaultVersion
+	}
+	if o.ClusterBits == 0 {
+		o.ClusterBits = defaultClusterBits
+	}
+	if o.RefcountBits == 0 {
+		o.RefcountBits = defaultRefcountBits
+	}
+
+	if o.Size < 0 {
+		exc.Throwf("Negative disk size %d", o.Size)
+	}
+	if o.Version < 2 || o.Version > 3 {
+		exc.Throwf("Unsupported qcow2 format version %d", o.Version)
+	}
+	if o.ClusterBits < 9 || o.ClusterBits > 21 {
+		exc.Throwf("Invalid qcow2 cluster bits %d", o.ClusterBits)
+	}
+	if o.RefcountBits < 2 || o.RefcountBits > 64 || o.RefcountBits&(o.RefcountBits-1) != 0 {
+		exc.Throwf("Invalid refcount bits %d", o.RefcountBits)
+	}
+	if o.Version == 2 && o.RefcountBits != 16 {
+		exc.Throwf("Version 2 requires 16-bit refcounts")
+	}
+	if o.Preallocation < PreallocOff || o.Preallocation > PreallocFull {
+		exc.Throwf("Invalid preallocation mode %d", o.Preallocation)
+	}
+}
+
+// Log2 of a power of two
+func log2(n int) uint32 {
+	var r uint32
+	for n > 1 {
+		n >>= 1
+		r++
+	}
+	return r
+}
+
+// Write a new, empty qcow2 file
+func create(rw eio.ReaderWriterAt, opts CreateOptions) *qcow2 {
+	opts.validate()
+
+	h := &headerImpl{bio: eio.NewIO(rw, binary.BigEndian)}
+	h.v2 = headerV2{
+		Magic:       magic,
+		Version:     uint32(opts.Version),
+		ClusterBits: uint32(opts.ClusterBits),
+		Size:        uint64(opts.Size),
+	}
+	h.v3.RefcountOrder = log2(opts.RefcountBits)
+	if opts.Version == 2 {
+		h.v3.HeaderLength = v2Length
+	} else {
+		h.v3.HeaderLength = v3Length
+	}
+
+	// The L1 table goes right after the header. Even if it's empty, it must
+	// have an offset.
+	cs := int64(h.clusterSize())
+	l1Entries := eio.DivCeil(eio.DivCeil(opts.Size, cs), cs/8)
+	l1Clusters := eio.DivCeil(l1Entries*8, cs)
+	h.v2.L1Size = uint32(l1Entries)
+	h.v2.L1TableOffset = uint64(cs)
+	h.bio.Zero(0, int((1+l1Clusters)*cs))
+
+	// Refcount structures go after that. This also writes the header.
+	counts := make([]uint64, 1+l1Clusters)
+	for i := range counts {
+		counts[i] = 1
+	}
+	r := &refcountsImpl{}
+	r.open(h)
+	r.rebuild(counts, 0)
+
+	// Open it properly, to make sure it's valid
+	q := &qcow2{header: &headerImpl{}}
+	q.header.open(rw)
+	q.preallocate(opts.Preallocation)
+	return q
+}
+
+// Create a new qcow2 file, with an empty guest disk
+func Create(rw eio.ReaderWriterAt, opts CreateOptions) (q Qcow2, err error) {
+	err = eio.BacktraceWrap(func() {
+		q = create(rw, opts)
+	})
+	return
+}
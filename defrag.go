@@ -0,0 +1,166 @@
+package qcow2
+
+// DefragResult describes how fragmented a file was before and after defragmentation.
+//
+// Fragmentation is the fraction of neighbouring allocated guest clusters that
+// are not neighbours in the host file, from 0 (contiguous) to 1.
+type DefragResult struct {
+	Before float64
+	After  float64
+}
+
+// A guest cluster that is mapped to a host cluster
+type guestMapping struct {
+	guest int64
+	host  int64
+}
+
+// Find the host clusters used by the active layer, in guest order
+func (c *compactor) activeMappings() []guestMapping {
+	cs := c.clusterSize()
+	l2Entries := cs / 8
+	w := &refWalker{header: c.header}
+
+	maps := make([]guestMapping, 0)
+	l1 := w.readTable(c.header.l1Offset(), c.header.l1Entries())
+	for i, l1e := range l1 {
+		l2 := int64(l1e & offsetMask)
+		if l2 == 0 {
+			continue
+		}
+		for j, e := range w.readTable(l2, int(l2Entries)) {
+			me := mapEntry(e)
+			off := int64(e & offsetMask)
+			if me.compressed() || me.zero() || off == 0 {
+				continue
+			}
+			guest := int64(i)*l2Entries + int64(j)
+			maps = append(maps, guestMapping{guest, off / cs})
+		}
+	}
+	return maps
+}
+
+// Measure fragmentation of the active layer
+func (c *compactor) fragmentation() float64 {
+	maps := c.activeMappings()
+	pairs, broken := 0, 0
+	for i := 1; i < len(maps); i++ {
+		if maps[i].guest != maps[i-1].guest+1 {
+			continue
+		}
+		pairs++
+		if maps[i].host != maps[i-1].host+1 {
+			broken++
+		}
+	}
+	if pairs == 0 {
+		return 0
+	}
+	return float64(broken) / float64(pairs)
+}
+
+// Rearrange data clusters so that guest order matches host order.
+//
+// Single-cluster structures are permuted among the host clusters they already
+// occupy, so the file doesn't grow: Metadata goes first, followed by the data
+// of the active layer. Compacting first will leave fewer gaps.
+func (c *compactor) defrag() *DefragResult {
+	// Reserve a temporary cluster to break cycles. Allocating may add refcount
+	// structures, so do it before finding where everything is.
+	tmp := c.refcounts.allocate(1, AllocFirstFit)
+	defer c.dropTemp(tmp)
+	c.scan()
+	res := &DefragResult{Before: c.fragmentation()}
+
+	// Find the movable data units, in guest order
+	seen := make(map[*compactUnit]bool)
+	data := make([]*compactUnit, 0)
+	for _, m := range c.activeMappings() {
+		u := c.owner[m.host]
+		if u == nil || u.pinned || u.kind != refData || seen[u] {
+			continue
+		}
+		seen[u] = true
+		data = append(data, u)
+	}
+
+	// Other single-cluster units, like L2 tables, are moved out of the way
+	// first, so the data can be contiguous.
+	units := make([]*compactUnit, 0)
+	slots := make([]int64, 0)
+	for i, u := range c.owner {
+		if u == nil || u.pinned || u.count != 1 {
+			continue
+		}
+		slots = append(slots, int64(i))
+		if !seen[u] {
+			units = append(units, u)
+		}
+	}
+	units = append(units, data...)
+
+	// Which unit wants each slot?
+	want := make(map[int64]*compactUnit)
+	target := make(map[*compactUnit]int64)
+	for i, u := range units {
+		want[slots[i]] = u
+		target[u] = slots[i]
+	}
+
+	// Count the moves we'll need. Each cycle needs an extra move.
+	visited := make(map[int64]bool)
+	for _, slot := range slots {
+		for s := slot; !visited[s] && want[s].start != s; s = want[s].start {
+			if s == slot {
+				c.total++
+			}
+			visited[s] = true
+			c.total++
+		}
+	}
+	if c.total == 0 {
+		res.After = res.Before
+		return res
+	}
+
+	for int64(len(c.owner)) <= tmp {
+		c.owner = append(c.owner, nil)
+	}
+
+	for _, slot := range slots {
+		u := c.owner[slot]
+		if target[u] == slot {
+			continue
+		}
+
+		// Follow the cycle starting at this slot
+		c.move(u, tmp)
+		free := slot
+		for {
+			next := want[free]
+			if next == u {
+				break
+			}
+			from := next.start
+			c.move(next, free)
+			free = from
+		}
+		c.move(u, free)
+	}
+
+	res.After = c.fragmentation()
+	return res
+}
+
+// Free the temporary cluster, unless a move already did, and drop it from the
+// end of the file
+func (c *compactor) dropTemp(tmp int64) {
+	if c.refcounts.refcount(tmp) != 0 {
+		c.refcounts.set(tmp, 0)
+	}
+	c.refcounts.flush()
+	if size, ok := c.header.io().Size(); ok && size == (tmp+1)*c.clusterSize() {
+		c.header.io().Truncate(tmp * c.clusterSize())
+	}
+}
@@ -0,0 +1,95 @@
+package qcow2
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDefragFullRefcountTable(t *testing.T) {
+	// With small clusters and wide refcounts, a one-cluster refcount table
+	// covers 4096 clusters. Fill them all with fragmented data, so the
+	// temporary cluster defrag needs makes the table grow.
+	q := tempImage(t, CreateOptions{Size: 4 << 20, ClusterBits: 9, RefcountBits: 64})
+	h := q.(*qcow2).header
+	cs := int64(h.clusterSize())
+	table := h.refcountOffset()
+	g, err := q.Guest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, h.size())
+	rnd := rand.New(rand.NewSource(1))
+	for _, idx := range rnd.Perm(int(h.size() / cs)) {
+		p := data[int64(idx)*cs : int64(idx+1)*cs]
+		rnd.Read(p)
+		if _, err := g.WriteAt(p, int64(idx)*cs); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if size, _ := h.io().Size(); size/cs >= q.(*qcow2).refcounts().max() {
+			break
+		}
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if h.refcountOffset() != table {
+		t.Fatal("Refcount table grew too early")
+	}
+
+	res, err := q.Defrag(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.After >= res.Before {
+		t.Fatalf("%+v", res)
+	}
+	requireClean(t, q)
+	verifyGuest(t, q, data)
+}
+
+func TestDefrag(t *testing.T) {
+	// Writing backwards puts guest clusters in reverse order
+	q := tempImage(t, CreateOptions{Size: 4 << 20, ClusterBits: 12})
+	h := q.(*qcow2).header
+	cs := int64(h.clusterSize())
+	g, err := q.Guest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	for off := int64(len(data)) - cs; off >= 0; off -= cs {
+		if _, err := g.WriteAt(data[off:off+cs], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := h.io().Size()
+
+	res, err := q.Defrag(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Before < 0.9 || res.After != 0 {
+		t.Fatalf("%+v", res)
+	}
+	if after, _ := h.io().Size(); after > before {
+		t.Fatalf("File grew from %d to %d", before, after)
+	}
+	requireClean(t, q)
+	verifyGuest(t, q, data)
+
+	// Defragmenting again does nothing
+	res, err = q.Defrag(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Before != 0 || res.After != 0 {
+		t.Fatalf("%+v", res)
+	}
+}
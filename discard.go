@@ -0,0 +1,98 @@
+package qcow2
+
+import (
+	"io"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// Get the range of host clusters an L2 entry points to.
+//
+// Returns ok = false if it doesn't point to any.
+func (g *guestImpl) hostClusters(e mapEntry) (first int64, last int64, ok bool) {
+	cs := int64(g.clusterSize())
+	if e.compressed() {
+		bits := g.header.clusterBits()
+		off := e.compressedOffset(bits)
+		return off / cs, (off + e.compressedSize(bits) - 1) / cs, true
+	}
+
+	off := int64(uint64(e) & offsetMask)
+	return off / cs, off / cs, off != 0
+}
+
+// Drop the references an L2 entry holds. Any host clusters that are no longer
+// used are deallocated once the change is flushed, if the storage supports it.
+func (g *guestImpl) freeEntry(e mapEntry) {
+	first, last, ok := g.hostClusters(e)
+	if !ok {
+		return
+	}
+
+	// The entry must be gone from disk before the clusters can be reused
+	g.refcounts.blockCache().setDependency(g.tables)
+
+	cs := int64(g.clusterSize())
+	for i := first; i <= last; i++ {
+		if g.refcounts.decrement(i, g.options.Reuse) == 0 {
+			g.tables.forget(i * cs)
+			g.compressedLock.Lock()
+			if g.compressedNext/cs == i {
+				g.compressedNext = 0
+			}
+			g.compressedLock.Unlock()
+		}
+	}
+}
+
+// Replace the L2 entry for a guest cluster, returning the old entry
+func (g *guestImpl) setL2(idx int64, e mapEntry) mapEntry {
+	l1 := g.getL1(idx, true)
+	off := l1.offset() + (idx%g.l2Entries())*8
+	old := mapEntry(g.tables.read(off))
+	g.tables.write(off, uint64(e))
+	return old
+}
+
+// Unmap a single guest cluster
+func (g *guestImpl) discardCluster(idx int64) {
+	lock := g.rangeLock(idx)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, _, ok := g.hostClusters(g.getL2(idx, false)); !ok {
+		return // Nothing to free
+	}
+
+	g.beginWrite()
+	// Without a backing file, unallocated clusters read as zero
+	g.freeEntry(g.setL2(idx, 0))
+}
+
+// Get the range of whole clusters in a region of the guest
+func (g *guestImpl) wholeClusters(off int64, length int64) (first int64, end int64) {
+	if off < 0 || length < 0 || off+length > g.size {
+		exc.ThrowOnError(io.ErrUnexpectedEOF)
+	}
+
+	cs := int64(g.clusterSize())
+	first = eio.DivCeil(off, cs)
+	end = (off + length) / cs
+	if off+length == g.size {
+		end = eio.DivCeil(g.size, cs) // The last cluster may be partial
+	}
+	return
+}
+
+func (g *guestImpl) Discard(off int64, length int64) error {
+	if g.readOnly {
+		return errOpenedReadOnly
+	}
+	return eio.BacktraceWrap(func() {
+		first, end := g.wholeClusters(off, length)
+		for idx := first; idx < end; idx++ {
+			g.discardCluster(idx)
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"io"
 	"math"
+	"os"
 
 	"github.com/timtadh/data-structures/exc"
 )
@@ -21,6 +22,21 @@ type ReaderWriterAt interface {
 	io.WriterAt
 }
 
+// HolePuncher is implemented by storage that can deallocate ranges of data.
+//
+// After a hole is punched, the range should read as zeros.
+type HolePuncher interface {
+	PunchHole(off int64, size int64) error
+}
+
+// SpaceAllocator is implemented by storage that can reserve space for a range
+// of data, without writing it.
+//
+// Reserved ranges that weren't written before should read as zeros.
+type SpaceAllocator interface {
+	Allocate(off int64, size int64) error
+}
+
 // BinaryIO allows I/O on binary data.
 //
 // It has an inherent byte-order, and uses exceptions to indicate error
@@ -41,6 +57,92 @@ func (bio *BinaryIO) ByteOrder() binary.ByteOrder {
 	return bio.order
 }
 
+// Size gets the size of the underlying data.
+//
+// The second return value is false if the size can't be determined.
+func (bio *BinaryIO) Size() (int64, bool) {
+	switch b := bio.base.(type) {
+	case interface {
+		Size() int64
+	}:
+		return b.Size(), true
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		fi, err := b.Stat()
+		exc.ThrowOnError(err)
+		if s, ok := bio.base.(io.Seeker); ok && !fi.Mode().IsRegular() {
+			// Devices don't report a size, but can seek to their end
+			size, err := s.Seek(0, io.SeekEnd)
+			exc.ThrowOnError(err)
+			return size, true
+		}
+		return fi.Size(), true
+	}
+	return 0, false
+}
+
+// Truncate changes the size of the underlying data.
+//
+// Returns false if the underlying data can't be truncated.
+func (bio *BinaryIO) Truncate(size int64) bool {
+	t, ok := bio.base.(interface {
+		Truncate(int64) error
+	})
+	if !ok {
+		return false
+	}
+	exc.ThrowOnError(t.Truncate(size))
+	return true
+}
+
+// Sync commits the underlying data to stable storage.
+//
+// Returns false if the underlying data can't be synced.
+func (bio *BinaryIO) Sync() bool {
+	s, ok := bio.base.(interface {
+		Sync() error
+	})
+	if !ok {
+		return false
+	}
+	exc.ThrowOnError(s.Sync())
+	return true
+}
+
+// PunchHole deallocates a range of the underlying data, so it reads as zeros.
+//
+// Returns false if the underlying data doesn't support this.
+func (bio *BinaryIO) PunchHole(off int64, size int64) bool {
+	switch b := bio.base.(type) {
+	case HolePuncher:
+		exc.ThrowOnError(b.PunchHole(off, size))
+		return true
+	case *os.File:
+		ok, err := punchHoleFile(b, off, size)
+		exc.ThrowOnError(err)
+		return ok
+	}
+	return false
+}
+
+// Allocate reserves space for a range of the underlying data, so later writes
+// there won't run out of space.
+//
+// Returns false if the underlying data doesn't support this.
+func (bio *BinaryIO) Allocate(off int64, size int64) bool {
+	switch b := bio.base.(type) {
+	case SpaceAllocator:
+		exc.ThrowOnError(b.Allocate(off, size))
+		return true
+	case *os.File:
+		ok, err := allocateFile(b, off, size)
+		exc.ThrowOnError(err)
+		return ok
+	}
+	return false
+}
+
 // ReadAt reads a byte slice at an offset.
 func (bio *BinaryIO) ReadAt(off int64, buf []byte) {
 	_, err := bio.base.ReadAt(buf, off)
@@ -0,0 +1,27 @@
+package eio
+
+// DivCeil divides, rounding up
+func DivCeil(d int64, q int64) int64 {
+	r := d / q
+	if d%q != 0 {
+		r++
+	}
+	return r
+}
+
+// ZeroFill fills a slice with zeros
+func ZeroFill(p []byte) {
+	for i := 0; i < len(p); i++ {
+		p[i] = 0
+	}
+}
+
+// IsZero checks if a slice is all zeros
+func IsZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -8,10 +8,11 @@ import (
 
 // Pipeline is a set of goroutines connected by channels, that may throw exceptions
 type Pipeline struct {
-	done chan struct{}
-	wait sync.WaitGroup
-	mut  sync.Mutex
-	err  exc.Throwable
+	done    chan struct{}
+	wait    sync.WaitGroup
+	mut     sync.Mutex
+	err     exc.Throwable
+	stopped bool
 }
 
 // NewPipeline creates a new pipeline
@@ -21,6 +22,7 @@ func NewPipeline() *Pipeline {
 		sync.WaitGroup{},
 		sync.Mutex{},
 		nil,
+		false,
 	}
 }
 
@@ -49,7 +51,13 @@ func (p *Pipeline) WaitThrow() {
 func (p *Pipeline) Stop() {
 	p.mut.Lock()
 	defer p.mut.Unlock()
-	if p.err == nil {
+	p.stop()
+}
+
+// Close the done channel, if it's not already closed. Must hold the mutex.
+func (p *Pipeline) stop() {
+	if !p.stopped {
+		p.stopped = true
 		close(p.done)
 	}
 }
@@ -64,7 +72,7 @@ func (p *Pipeline) Go(f func()) {
 			defer p.mut.Unlock()
 			if p.err == nil {
 				p.err = e
-				close(p.done)
+				p.stop()
 			}
 		}).Error()
 	}()
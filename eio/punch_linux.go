@@ -0,0 +1,29 @@
+package eio
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// Deallocate a range of a file. Returns false if this isn't supported.
+func punchHoleFile(f *os.File, off int64, size int64) (bool, error) {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, off, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Reserve space for a range of a file. Returns false if this isn't supported.
+func allocateFile(f *os.File, off int64, size int64) (bool, error) {
+	err := syscall.Fallocate(int(f.Fd()), 0, off, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package eio
+
+import "os"
+
+// Deallocate a range of a file. Returns false if this isn't supported.
+func punchHoleFile(f *os.File, off int64, size int64) (bool, error) {
+	return false, nil
+}
+
+// Reserve space for a range of a file. Returns false if this isn't supported.
+func allocateFile(f *os.File, off int64, size int64) (bool, error) {
+	return false, nil
+}
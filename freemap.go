@@ -0,0 +1,149 @@
+package qcow2
+
+import (
+	"math"
+	"math/bits"
+)
+
+// AllocStrategy controls where new clusters are placed in the file
+type AllocStrategy int
+
+const (
+	// AllocFirstFit uses the first free clusters in the file, filling holes.
+	AllocFirstFit AllocStrategy = iota
+	// AllocAppend always places new clusters after the last used one.
+	AllocAppend
+	// AllocContiguous continues right after the previous allocation if
+	// possible, so data written in order stays contiguous in the file. It
+	// falls back to the first fit.
+	AllocContiguous
+)
+
+// ReusePolicy controls when clusters that are freed may be allocated again
+type ReusePolicy int
+
+const (
+	// ReuseAfterFlush reuses freed clusters once the metadata changes that
+	// freed them are written. Until then, a crash could leave the old
+	// mapping pointing at the cluster, so reusing it could expose new data
+	// in the wrong place.
+	ReuseAfterFlush ReusePolicy = iota
+	// ReuseImmediately writes the metadata changes as soon as clusters are
+	// freed, so they can be reused right away. This costs extra writes.
+	ReuseImmediately
+	// ReuseNever doesn't reuse clusters freed while the file is open.
+	ReuseNever
+)
+
+// A bitmap of which clusters are in use. Clusters past the end of the bitmap
+// are free.
+type freeMap struct {
+	words []uint64
+	// One past the last used cluster
+	end int64
+	// Where the previous allocation ended
+	next int64
+}
+
+// Is a cluster in use?
+func (m *freeMap) used(idx int64) bool {
+	w := idx / 64
+	return w < int64(len(m.words)) && m.words[w]&(1<<uint(idx%64)) != 0
+}
+
+// Mark a sequence of clusters as used
+func (m *freeMap) use(idx int64, n int64) {
+	for i := idx; i < idx+n; i++ {
+		w := i / 64
+		for w >= int64(len(m.words)) {
+			m.words = append(m.words, 0)
+		}
+		m.words[w] |= 1 << uint(i%64)
+	}
+	if idx+n > m.end {
+		m.end = idx + n
+	}
+}
+
+// Mark a cluster as free
+func (m *freeMap) free(idx int64) {
+	if !m.used(idx) {
+		return
+	}
+	m.words[idx/64] &^= 1 << uint(idx%64)
+	for m.end > 0 && !m.used(m.end-1) {
+		m.end--
+	}
+}
+
+// Mark a cluster as free, unless the reuse policy forbids it
+func (m *freeMap) release(idx int64, reuse ReusePolicy) {
+	if reuse != ReuseNever {
+		m.free(idx)
+	}
+}
+
+// Find the first free cluster at or after idx
+func (m *freeMap) nextFree(idx int64) int64 {
+	for w := idx / 64; w < int64(len(m.words)); w++ {
+		word := ^m.words[w]
+		if w == idx/64 {
+			word &^= 1<<uint(idx%64) - 1
+		}
+		if word != 0 {
+			return w*64 + int64(bits.TrailingZeros64(word))
+		}
+	}
+	if idx < m.end {
+		return m.end
+	}
+	return idx
+}
+
+// Find the first used cluster at or after idx, or MaxInt64 if there is none
+func (m *freeMap) nextUsed(idx int64) int64 {
+	if idx >= m.end {
+		return math.MaxInt64
+	}
+	for w := idx / 64; w < int64(len(m.words)); w++ {
+		word := m.words[w]
+		if w == idx/64 {
+			word &^= 1<<uint(idx%64) - 1
+		}
+		if word != 0 {
+			return w*64 + int64(bits.TrailingZeros64(word))
+		}
+	}
+	return math.MaxInt64
+}
+
+// Is there a sequence of n free clusters at idx?
+func (m *freeMap) fits(idx int64, n int64) bool {
+	return m.nextUsed(idx)-idx >= n
+}
+
+// Find the start of a sequence of n free clusters, without marking them used
+func (m *freeMap) find(n int64, strategy AllocStrategy) int64 {
+	switch strategy {
+	case AllocAppend:
+		return m.end
+	case AllocContiguous:
+		if m.next > 0 && m.fits(m.next, n) {
+			return m.next
+		}
+	}
+
+	for idx := m.nextFree(0); ; idx = m.nextFree(m.nextUsed(idx)) {
+		if m.fits(idx, n) {
+			return idx
+		}
+	}
+}
+
+// Find a sequence of n free clusters, and mark them used
+func (m *freeMap) allocate(n int64, strategy AllocStrategy) int64 {
+	idx := m.find(n, strategy)
+	m.use(idx, n)
+	m.next = idx + n
+	return idx
+}
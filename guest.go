@@ -11,14 +11,31 @@ import (
 
 // Guest allows access to the data of a qcow2 file as a guest OS sees them
 type Guest interface {
-	// Setup a new guest
-	open(header header, refcounts refcounts, l1 int64, size int64)
 	Close() error
 
 	// Read and write at positions
 	eio.ReaderWriterAt
 	// Get the size of this disk
 	Size() int64
+	// Write any cached metadata, and sync the file if possible, so everything
+	// written so far is on stable storage
+	Flush() error
+
+	// Unmap the clusters entirely within a range, so they read as zeros.
+	// Host space is reclaimed when possible.
+	Discard(off int64, length int64) error
+	// Make a range read as zeros. Whole clusters are zeroed without writing
+	// data when possible, and if mayUnmap is true their host space may be freed.
+	WriteZeroes(off int64, length int64, mayUnmap bool) error
+
+	// Get the allocation status of a range, as a list of extents
+	Map(off int64, length int64) ([]Extent, error)
+	// Find the next position at or after off that holds data, like SEEK_DATA.
+	// Returns io.EOF if there is none.
+	SeekData(off int64) (int64, error)
+	// Find the next position at or after off that reads as zeros without
+	// holding data, like SEEK_HOLE. The end of the disk counts as a hole.
+	SeekHole(off int64) (int64, error)
 }
 
 // Bits for mapEntry
@@ -26,7 +43,8 @@ const (
 	noCow      uint64 = 1 << 63
 	compressed uint64 = 1 << 62
 	zeroBit    uint64 = 1
-	l1Valid    uint64 = noCow | (1<<56-1)&^0x1ff
+	offsetMask uint64 = (1<<56 - 1) &^ 0x1ff
+	l1Valid    uint64 = noCow | offsetMask
 	l2Valid    uint64 = l1Valid | compressed | zeroBit
 )
 
@@ -39,7 +57,8 @@ func (e mapEntry) compressed() bool {
 
 // Is this entry a forced-zero block?
 func (e mapEntry) zero() bool { // For L2 only
-	return uint64(e)&zeroBit != 0
+	// Compressed entries use this bit as part of the offset
+	return uint64(e)&(zeroBit|compressed) == zeroBit
 }
 
 // Is this entry empty?
@@ -55,6 +74,27 @@ func (e mapEntry) offset() int64 {
 	return int64(uint64(e) &^ (noCow | compressed))
 }
 
+// Where does the compressed data for this entry start? (For compressed L2 entries only)
+func (e mapEntry) compressedOffset(clusterBits int) int64 {
+	x := uint(62 - (clusterBits - 8))
+	return int64(uint64(e) & (1<<x - 1))
+}
+
+// How many bytes of compressed data may this entry use? (For compressed L2 entries only)
+func (e mapEntry) compressedSize(clusterBits int) int64 {
+	x := uint(62 - (clusterBits - 8))
+	sectors := int64((uint64(e)>>x)&(1<<uint(clusterBits-8)-1)) + 1
+	off := e.compressedOffset(clusterBits)
+	return sectors*512 - off%512
+}
+
+// Make an L2 entry for compressed data at a given offset
+func compressedEntry(off int64, size int64, clusterBits int) mapEntry {
+	x := uint(62 - (clusterBits - 8))
+	sectors := (off+size-1)/512 - off/512
+	return mapEntry(compressed | uint64(off) | uint64(sectors)<<x)
+}
+
 // Does this cluster need to be copied before writing?
 func (e mapEntry) cow() bool {
 	return uint64(e)&noCow == 0 && !e.nil()
@@ -65,30 +105,118 @@ func (e mapEntry) writable() bool {
 	return e.hasOffset() && !e.cow()
 }
 
+// Is this a preallocated zero cluster, that only we use?
+func (e mapEntry) preallocated() bool {
+	return e.zero() && uint64(e)&noCow != 0 && uint64(e)&offsetMask != 0
+}
+
+// GuestOptions control how a Guest behaves
+type GuestOptions struct {
+	// Record writes of whole clusters of zeros as unallocated clusters,
+	// rather than allocating space for them.
+	DetectZeroes bool
+	// How many bytes of L1 and L2 tables to cache. Changes are written back
+	// when they're evicted, or when the guest is closed. Zero means a default
+	// of 1 MB, and a negative size disables caching. All open guests of a
+	// file share one cache, sized by the first of them to be opened.
+	CacheSize int64
+	// Write data even if it's identical to what's already there. This skips
+	// reading the existing data to compare, but unchanged clusters that are
+	// shared or unallocated get new copies.
+	WriteUnchanged bool
+	// Where to place newly allocated clusters. Defaults to the first fit.
+	Allocation AllocStrategy
+	// When clusters this guest frees may be allocated again. Defaults to
+	// after the next flush.
+	Reuse ReusePolicy
+}
+
+// Mapping state shared by all guests of a file, so changes one makes are
+// seen by the others
+type guestShared struct {
+	tables *metadataCache
+
+	// Locks for ranges of the guest, each covering a set of L2 tables. I/O to
+	// clusters that are already writable shares the lock, changes to mapping
+	// entries hold it exclusively.
+	rangeLocks [rangeLockCount]sync.RWMutex
+}
+
+func newGuestShared(header header, cacheSize int64) *guestShared {
+	return &guestShared{
+		tables: newMetadataCache(header.io(), header.clusterSize(), cacheSize),
+	}
+}
+
 type guestImpl struct {
 	header     header
 	refcounts  refcounts
 	l1Position int64
 	size       int64
+	options    GuestOptions
+	*guestShared
+	// The file we belong to, if any
+	owner *qcow2
+	// Reject changes, because the file was opened read-only
+	readOnly bool
+
+	// Where the next compressed data can be packed, or zero if a new cluster
+	// is needed
+	compressedNext int64
+	compressedLock sync.Mutex
+}
 
-	// Synchronize metadata changes only, block changes can stomp on each other
-	sync.RWMutex
+// How many range locks each file has
+const rangeLockCount = 64
+
+// Get the lock for the range holding a guest cluster
+func (g *guestImpl) rangeLock(idx int64) *sync.RWMutex {
+	return &g.rangeLocks[(idx/g.l2Entries())%rangeLockCount]
 }
 
-func (g *guestImpl) open(header header, refcounts refcounts, l1 int64, size int64) {
+func (g *guestImpl) open(header header, refcounts refcounts, shared *guestShared, l1 int64, size int64) {
 	g.header = header
 	g.refcounts = refcounts
+	g.guestShared = shared
 	g.l1Position = l1
 	g.size = size
 }
 
 func (g *guestImpl) Close() error {
 	return eio.BacktraceWrap(func() {
+		g.flush()
 		g.header.close()
 		g.refcounts.close()
+		if g.owner != nil {
+			g.owner.guestClosed(g)
+		}
 	})
 }
 
+func (g *guestImpl) Flush() error {
+	if g.readOnly {
+		return nil
+	}
+	return eio.BacktraceWrap(func() {
+		g.flush()
+		g.io().Sync()
+	})
+}
+
+// Get ready to change metadata for the first time, by clearing unknown
+// autoclear features and marking the file dirty.
+func (g *guestImpl) beginWrite() {
+	g.header.autoclear()
+	g.header.setDirty(true)
+}
+
+// Write all cached metadata to the file. Mapping tables are written after any
+// refcounts they depend on, and vice versa.
+func (g *guestImpl) flush() {
+	g.tables.flush()
+	g.refcounts.flush()
+}
+
 func (g *guestImpl) io() *eio.BinaryIO {
 	return g.header.io()
 }
@@ -100,9 +228,9 @@ func (g *guestImpl) clusterSize() int {
 
 // How big can the L1 be, in clusters?
 func (g *guestImpl) l1Clusters() int {
-	clusters := divceil(g.size, int64(g.clusterSize()))
-	l1Entries := divceil(clusters, g.l2Entries())
-	return int(divceil(l1Entries*8, int64(g.clusterSize())))
+	clusters := eio.DivCeil(g.size, int64(g.clusterSize()))
+	l1Entries := eio.DivCeil(clusters, g.l2Entries())
+	return int(eio.DivCeil(l1Entries*8, int64(g.clusterSize())))
 }
 
 // How many entries in an L2 table?
@@ -123,7 +251,7 @@ func (g *guestImpl) validateL2(e mapEntry) {
 		return
 	}
 	if e.compressed() {
-		exc.Throwf("Compression not supported")
+		return // Compressed data needn't be aligned
 	}
 	g.validateL1(e)
 }
@@ -138,34 +266,55 @@ type entryValidator func(mapEntry)
 // writable  - whether or not the cluster the entry points to needs to be safe for
 //		       writing on return
 func (g *guestImpl) getEntry(validator entryValidator, off int64, writable bool) mapEntry {
-	oldEntry := mapEntry(g.io().ReadUint64(off))
+	oldEntry := mapEntry(g.tables.read(off))
 	validator(oldEntry)
 	if !writable || oldEntry.writable() {
 		return oldEntry
 	}
 
+	if e, ok := g.clearPreallocated(off, oldEntry); ok {
+		return e
+	}
+
 	// Need to make it writable, so allocate a new block
-	alloc := g.refcounts.allocate(1) * int64(g.clusterSize())
+	alloc := g.refcounts.allocate(1, g.options.Allocation) * int64(g.clusterSize())
 	newEntry := mapEntry(uint64(alloc) | noCow)
+	g.initCluster(alloc, oldEntry)
 
-	// Initialize the new block
-	if oldEntry.hasOffset() {
-		g.io().Copy(alloc, oldEntry.offset(), g.clusterSize())
-	} else {
-		g.io().Zero(alloc, g.clusterSize())
-	}
-
-	// Write it to the parent
-	g.io().WriteUint64(off, uint64(newEntry))
+	// Write it to the parent, once the allocation is on disk
+	g.tables.setDependency(g.refcounts.blockCache())
+	g.tables.write(off, uint64(newEntry))
 
 	// Deref the old value
-	if oldEntry.hasOffset() {
-		g.refcounts.decrement(oldEntry.offset() / int64(g.clusterSize()))
-	}
+	g.freeEntry(oldEntry)
 
 	return newEntry
 }
 
+// A preallocated zero cluster that only we use can just be cleared, to make it
+// writable. Returns false if the entry isn't such a cluster.
+func (g *guestImpl) clearPreallocated(off int64, e mapEntry) (mapEntry, bool) {
+	if !e.preallocated() {
+		return e, false
+	}
+	newEntry := mapEntry(uint64(e) &^ zeroBit)
+	g.io().Zero(newEntry.offset(), g.clusterSize())
+	g.tables.write(off, uint64(newEntry))
+	return newEntry, true
+}
+
+// Initialize a newly allocated cluster with the contents of an old entry
+func (g *guestImpl) initCluster(alloc int64, oldEntry mapEntry) {
+	if oldEntry.compressed() {
+		g.io().WriteAt(alloc, g.readCompressed(oldEntry))
+	} else if oldEntry.hasOffset() {
+		g.io().Copy(alloc, oldEntry.offset(), g.clusterSize())
+	} else {
+		g.io().Zero(alloc, g.clusterSize())
+	}
+	g.tables.forget(alloc)
+}
+
 // Get the L1 entry for the cluster at the given guest index
 func (g *guestImpl) getL1(idx int64, writable bool) mapEntry {
 	off := g.l1Position + (idx/g.l2Entries())*8
@@ -182,98 +331,313 @@ func (g *guestImpl) getL2(idx int64, writable bool) mapEntry {
 	return g.getEntry(g.validateL2, off, writable)
 }
 
-// Fill a slice with zeros
-func zeroFill(p []byte) {
-	for i := 0; i < len(p); i++ {
-		p[i] = 0
-	}
-}
-
 // Read a segment of a cluster, given its L2 entry
 func (g *guestImpl) readByL2(p []byte, l2 mapEntry, off int) {
-	if l2.nil() || l2.zero() {
-		zeroFill(p)
+	if l2.compressed() {
+		copy(p, g.readCompressed(l2)[off:])
+	} else if l2.nil() || l2.zero() {
+		eio.ZeroFill(p)
 	} else {
 		g.io().ReadAt(l2.offset()+int64(off), p)
 	}
 }
 
-// Read a segment of a cluster
+// A segment of a request that lies within a single cluster
+type clusterSpan struct {
+	idx        int64 // The index of the cluster within the guest disk
+	start, end int   // The position of the segment within the request
+	off        int   // The offset inside the cluster where the segment starts
+}
+
+// Does the segment overwrite its entire host cluster?
+func (s clusterSpan) full(clusterSize int) bool {
+	return s.end-s.start == clusterSize
+}
+
+// Split a request into its segments within each cluster
+func (g *guestImpl) clusterSpans(length int, idx int64, off int) []clusterSpan {
+	var spans []clusterSpan
+	for pos := 0; pos < length; idx++ {
+		end := pos + g.clusterSize() - off
+		if end > length {
+			end = length
+		}
+		spans = append(spans, clusterSpan{idx, pos, end, off})
+		pos = end
+		off = 0
+	}
+	return spans
+}
+
+// Collects I/O to host data, so contiguous segments are done all at once
+type hostRun struct {
+	io         func(off int64, p []byte)
+	p          []byte
+	host       int64
+	start, end int
+}
+
+// Add a segment of the request, at a host offset
+func (r *hostRun) add(host int64, start, end int) {
+	if r.end > r.start && r.end == start && r.host+int64(r.end-r.start) == host {
+		r.end = end
+		return
+	}
+	r.flush()
+	r.host, r.start, r.end = host, start, end
+}
+
+// Perform any pending I/O
+func (r *hostRun) flush() {
+	if r.end > r.start {
+		r.io(r.host, r.p[r.start:r.end])
+	}
+	r.start, r.end = 0, 0
+}
+
+// Read a range within a single L2 table
 // p   - The buffer to read into
-// idx - The index of the cluster within the guest disk
-// off - The offset inside the cluster to start reading
-func (g *guestImpl) readCluster(p []byte, idx int64, off int) {
-	var l2 mapEntry
-	func() {
-		g.RLock()
-		defer g.RUnlock()
-		l2 = g.getL2(idx, false)
-	}()
-	g.readByL2(p, l2, off)
-}
-
-// Write a segment of a cluster
-func (g *guestImpl) writeCluster(p []byte, idx int64, off int) {
-	// Check if there are any changes
-	orig := make([]byte, len(p))
-	g.readCluster(orig, idx, off)
-	if bytes.Compare(orig, p) == 0 {
-		// No changes, don't do anything
+// idx - The index of the first cluster within the guest disk
+// off - The offset inside the first cluster to start reading
+func (g *guestImpl) readRange(p []byte, idx int64, off int) {
+	// Hold the lock while reading, so clusters can't be freed meanwhile
+	lock := g.rangeLock(idx)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if g.getL1(idx, false).nil() {
+		eio.ZeroFill(p)
 		return
 	}
 
-	var l2 mapEntry
-	func() {
-		g.Lock()
-		defer g.Unlock()
+	run := hostRun{io: g.io().ReadAt, p: p}
+	for _, s := range g.clusterSpans(len(p), idx, off) {
+		l2 := g.getL2(s.idx, false)
+		if l2.compressed() || l2.nil() || l2.zero() {
+			g.readByL2(p[s.start:s.end], l2, s.off)
+		} else {
+			run.add(l2.offset()+int64(s.off), s.start, s.end)
+		}
+	}
+	run.flush()
+}
 
-		// Must autoclear header before first write
-		g.header.autoclear()
+// Does a segment of a cluster cover the whole cluster?
+func (g *guestImpl) wholeCluster(p []byte, idx int64, off int) bool {
+	if off != 0 {
+		return false
+	}
+	return len(p) == g.clusterSize() || idx*int64(g.clusterSize())+int64(len(p)) == g.size
+}
 
-		// Get a writable L2 entry
-		l2 = g.getL2(idx, true)
-	}()
+// Write a range within a single L2 table
+func (g *guestImpl) writeRange(p []byte, idx int64, off int) {
+	g.writeRangeCompare(p, idx, off, !g.options.WriteUnchanged)
+}
 
-	g.io().WriteAt(l2.offset()+int64(off), p)
-	return
+// Write a range within a single L2 table, optionally skipping clusters whose
+// data wouldn't change
+func (g *guestImpl) writeRangeCompare(p []byte, idx int64, off int, compare bool) {
+	if !g.options.DetectZeroes {
+		g.writeData(p, idx, off, compare)
+		return
+	}
+
+	// Zero whole clusters by changing their mapping, and write the rest
+	pos := 0
+	for _, s := range g.clusterSpans(len(p), idx, off) {
+		seg := p[s.start:s.end]
+		if !g.wholeCluster(seg, s.idx, s.off) || !eio.IsZero(seg) {
+			continue
+		}
+		if s.start > pos {
+			g.writeData(p[pos:s.start], idx, off, compare)
+		}
+		g.zeroCluster(s.idx, true)
+		pos, idx, off = s.end, s.idx+1, 0
+	}
+	if pos < len(p) {
+		g.writeData(p[pos:], idx, off, compare)
+	}
 }
 
-// A function to process a cluster
-type clusterFunc func(g *guestImpl, p []byte, idx int64, off int)
+// Write data to a range within a single L2 table
+func (g *guestImpl) writeData(p []byte, idx int64, off int, compare bool) {
+	spans := g.clusterSpans(len(p), idx, off)
+	if compare {
+		// Only write the clusters that change
+		orig := make([]byte, len(p))
+		g.readRange(orig, idx, off)
+		changed := spans[:0]
+		for _, s := range spans {
+			if !bytes.Equal(orig[s.start:s.end], p[s.start:s.end]) {
+				changed = append(changed, s)
+			}
+		}
+		spans = changed
+		if len(spans) == 0 {
+			// No changes, don't do anything
+			return
+		}
+	}
 
-// Given a slice that may span clusters, break it down into single-cluster operations
-func (g *guestImpl) perCluster(p []byte, off int64, f clusterFunc) int {
-	if off+int64(len(p)) > g.size {
+	// Usually the clusters are already writable, and other I/O can continue
+	lock := g.rangeLock(idx)
+	lock.RLock()
+	if g.writeMapped(p, spans) {
+		lock.RUnlock()
+		return
+	}
+	lock.RUnlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+	g.beginWrite()
+	g.writeAllocating(p, spans)
+}
+
+// Write segments of a request, if all their clusters are writable without
+// changes to the mapping tables. Returns false if nothing was written.
+//
+// Must hold the range lock.
+func (g *guestImpl) writeMapped(p []byte, spans []clusterSpan) bool {
+	if !g.getL1(spans[0].idx, false).writable() {
+		return false
+	}
+	hosts := make([]int64, len(spans))
+	for i, s := range spans {
+		l2 := g.getL2(s.idx, false)
+		if !l2.writable() {
+			return false
+		}
+		hosts[i] = l2.offset() + int64(s.off)
+	}
+
+	run := hostRun{io: g.io().WriteAt, p: p}
+	for i, s := range spans {
+		run.add(hosts[i], s.start, s.end)
+	}
+	run.flush()
+	return true
+}
+
+// An L2 entry to change, once the data for its cluster is written
+type pendingEntry struct {
+	off  int64
+	old  mapEntry
+	span int // The index of the segment that writes to the cluster
+}
+
+// Write segments of a request, making their clusters writable first. Any new
+// clusters are allocated all at once, so they're contiguous.
+//
+// The data is written before the mapping tables point at it. Clusters that
+// are entirely overwritten aren't initialized first.
+//
+// Must hold the range lock exclusively.
+func (g *guestImpl) writeAllocating(p []byte, spans []clusterSpan) {
+	l1 := g.getL1(spans[0].idx, true)
+	hosts := make([]int64, len(spans))
+	var pending, reused []pendingEntry
+	for i, s := range spans {
+		off := l1.offset() + (s.idx%g.l2Entries())*8
+		e := mapEntry(g.tables.read(off))
+		g.validateL2(e)
+		if e.preallocated() && s.full(g.clusterSize()) {
+			// No need to clear it, just mark it as data once it's written
+			reused = append(reused, pendingEntry{off, e, i})
+			e = mapEntry(uint64(e) &^ zeroBit)
+		} else if !e.writable() {
+			if cleared, ok := g.clearPreallocated(off, e); ok {
+				e = cleared
+			} else {
+				pending = append(pending, pendingEntry{off, e, i})
+				continue
+			}
+		}
+		hosts[i] = e.offset() + int64(s.off)
+	}
+
+	cs := int64(g.clusterSize())
+	var alloc int64
+	if len(pending) > 0 {
+		alloc = g.refcounts.allocate(int64(len(pending)), g.options.Allocation) * cs
+	}
+	for j, e := range pending {
+		s := spans[e.span]
+		host := alloc + int64(j)*cs
+		if s.full(g.clusterSize()) {
+			g.tables.forget(host)
+		} else {
+			g.initCluster(host, e.old)
+		}
+		hosts[e.span] = host + int64(s.off)
+	}
+
+	run := hostRun{io: g.io().WriteAt, p: p}
+	for i, s := range spans {
+		run.add(hosts[i], s.start, s.end)
+	}
+	run.flush()
+
+	for _, e := range reused {
+		g.tables.write(e.off, uint64(e.old)&^zeroBit)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	// Write the new entries, once the allocations are on disk
+	g.tables.setDependency(g.refcounts.blockCache())
+	for i, e := range pending {
+		g.tables.write(e.off, uint64(alloc+int64(i)*cs)|noCow)
+	}
+
+	// Deref the old values
+	for _, e := range pending {
+		g.freeEntry(e.old)
+	}
+}
+
+// A function to process a range within a single L2 table
+type rangeFunc func(g *guestImpl, p []byte, idx int64, off int)
+
+// Given a slice that may span L2 tables, break it down into operations that
+// each use a single L2 table
+func (g *guestImpl) perL2(p []byte, off int64, f rangeFunc) int {
+	if off < 0 || off+int64(len(p)) > g.size {
 		exc.ThrowOnError(io.ErrUnexpectedEOF)
 	}
 
-	idx := int64(off / int64(g.clusterSize()))
-	offset := int(off % int64(g.clusterSize()))
+	cs := int64(g.clusterSize())
+	span := cs * g.l2Entries()
 	bytes := 0
 	for len(p) > 0 {
-		length := g.clusterSize() - offset
-		if length > len(p) {
-			length = len(p)
+		length := span - off%span
+		if length > int64(len(p)) {
+			length = int64(len(p))
 		}
-		f(g, p[:length], idx, offset)
+		f(g, p[:length], off/cs, int(off%cs))
 		p = p[length:]
-		idx++
-		offset = 0
-		bytes += length
+		off += length
+		bytes += int(length)
 	}
 	return bytes
 }
 
 func (g *guestImpl) ReadAt(p []byte, off int64) (n int, err error) {
 	err = eio.BacktraceWrap(func() {
-		n = g.perCluster(p, off, (*guestImpl).readCluster)
+		n = g.perL2(p, off, (*guestImpl).readRange)
 	})
 	return
 }
 
 func (g *guestImpl) WriteAt(p []byte, off int64) (n int, err error) {
+	if g.readOnly {
+		return 0, errOpenedReadOnly
+	}
 	err = eio.BacktraceWrap(func() {
-		n = g.perCluster(p, off, (*guestImpl).writeCluster)
+		n = g.perL2(p, off, (*guestImpl).writeRange)
 	})
 	return
 }
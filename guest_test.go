@@ -0,0 +1,124 @@
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// The expected contents of some guest clusters
+type guestModel map[int64][]byte
+
+func (m guestModel) cluster(idx int64, cs int) []byte {
+	if m[idx] == nil {
+		m[idx] = make([]byte, cs)
+	}
+	return m[idx]
+}
+
+// Check that a cluster of the guest matches the model
+func (m guestModel) verify(g Guest, idx int64, cs int) error {
+	p := make([]byte, cs)
+	if _, err := g.ReadAt(p, idx*int64(cs)); err != nil {
+		return err
+	}
+	if !bytes.Equal(p, m.cluster(idx, cs)) {
+		return fmt.Errorf("Cluster %d doesn't match", idx)
+	}
+	return nil
+}
+
+// Do random I/O on every nth guest cluster, starting at first
+func stressWorker(g Guest, first int64, n int64, cs int, ops int, seed int64) (guestModel, error) {
+	model := guestModel{}
+	rnd := rand.New(rand.NewSource(seed))
+	clusters := g.Size() / int64(cs)
+	for i := 0; i < ops; i++ {
+		idx := first + rnd.Int63n((clusters-first+n-1)/n)*n
+		off := rnd.Intn(cs)
+		length := rnd.Intn(cs-off) + 1
+		data := model.cluster(idx, cs)
+		pos := idx*int64(cs) + int64(off)
+
+		var err error
+		switch rnd.Intn(6) {
+		case 0:
+			err = g.Discard(idx*int64(cs), int64(cs))
+			copy(data, make([]byte, cs))
+		case 1:
+			err = g.WriteZeroes(pos, int64(length), rnd.Intn(2) == 0)
+			copy(data[off:off+length], make([]byte, length))
+		case 2:
+			err = model.verify(g, idx, cs)
+		default:
+			rnd.Read(data[off : off+length])
+			_, err = g.WriteAt(data[off:off+length], pos)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return model, nil
+}
+
+func TestGuestStress(t *testing.T) {
+	const (
+		clusterBits = 12
+		workers     = 8
+		ops         = 2000
+	)
+	cs := 1 << clusterBits
+	for _, opts := range []GuestOptions{
+		{},
+		{CacheSize: -1},
+		{DetectZeroes: true, Allocation: AllocContiguous, Reuse: ReuseImmediately},
+		{WriteUnchanged: true, CacheSize: int64(cs), Reuse: ReuseNever},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			q := tempImage(t, CreateOptions{Size: 16 << 20, ClusterBits: clusterBits})
+			g, err := q.GuestWithOptions(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Workers use interleaved clusters, so they share L2 tables
+			models := make([]guestModel, workers)
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					m, err := stressWorker(g, int64(w), workers, cs, ops, int64(w))
+					if err != nil {
+						t.Error(err)
+					}
+					models[w] = m
+				}(w)
+			}
+			wg.Wait()
+			if t.Failed() {
+				return
+			}
+
+			for _, m := range models {
+				for idx := range m {
+					if err := m.verify(g, idx, cs); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := g.Close(); err != nil {
+				t.Fatal(err)
+			}
+			res, err := q.Check(CheckOnly)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.Clean() {
+				t.Fatal(res.Problems)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/timtadh/data-structures/exc"
 	"github.com/vasi/qcow2/eio"
@@ -16,21 +17,33 @@ type header interface {
 
 	write()
 	autoclear()
+	// Whether refcounts may be out of date, because we were interrupted
+	dirty() bool
+	// Set or clear the dirty bit, and make sure it's on disk
+	setDirty(dirty bool)
 
 	version() int
 	clusterSize() int
+	clusterBits() int
 
 	l1Entries() int
 	l1Offset() int64
+	setL1Offset(offset int64)
 	size() int64
 
 	refcountOffset() int64
 	refcountClusters() int
+	// Get both the offset and size of the refcount table at once
+	refcountTable() (offset int64, clusters int)
 	refcountBits() int
 	setRefcountTable(offset int64, size int)
 
 	snapshotsOffset() int64
 	snapshotsCount() int
+	setSnapshotsOffset(offset int64)
+
+	extension(id uint32) []byte
+	autoclearFeatures() uint64
 
 	io() *eio.BinaryIO
 }
@@ -41,6 +54,7 @@ const (
 	magic uint32 = 0x514649fb
 
 	featureNameExtensionID uint32      = 0x6803f857
+	bitmapsExtensionID     uint32      = 0x23852875
 	incompatible           featureType = 0
 	compatible             featureType = 1
 	autoclear              featureType = 2
@@ -92,6 +106,9 @@ type headerImpl struct {
 	extraHeader  []byte
 	extensions   map[uint32][]byte
 	featureNames []featureName
+
+	// Synchronize fields that change while guests are running
+	sync.RWMutex
 }
 
 func (h *headerImpl) open(rw eio.ReaderWriterAt) {
@@ -103,6 +120,9 @@ func (h *headerImpl) open(rw eio.ReaderWriterAt) {
 		exc.Throwf("Not a qcow2 file")
 	}
 	h.bio.ReadData(4, &h.v2.Version)
+	if h.v2.Version == 1 {
+		exc.Throwf("qcow version 1 files must be opened with OpenQcow1")
+	}
 	if h.v2.Version < 2 || h.v2.Version > 3 {
 		exc.Throwf("Unsupported qcow2 format version %d", h.v2.Version)
 	}
@@ -132,9 +152,9 @@ func (h *headerImpl) read(r *eio.SequentialReader) {
 		exc.Throwf("Encryption is not supported")
 	}
 
-	guestBlocks := divceil(int64(h.v2.Size), int64(h.clusterSize()))
+	guestBlocks := eio.DivCeil(int64(h.v2.Size), int64(h.clusterSize()))
 	l2Entries := h.clusterSize() / 8
-	l1Entries := divceil(guestBlocks, int64(l2Entries))
+	l1Entries := eio.DivCeil(guestBlocks, int64(l2Entries))
 	if l1Entries > int64(h.v2.L1Size) {
 		exc.Throwf("Too few L1 entries for disk size")
 	}
@@ -168,10 +188,6 @@ func (h *headerImpl) read(r *eio.SequentialReader) {
 		if h.v3.IncompatibleFeatures&featureCorrupt != 0 {
 			exc.Throwf("Corrupt bit is set")
 		}
-		if h.v3.IncompatibleFeatures&featureDirty != 0 {
-			exc.Throwf("Dirty bit is set")
-		}
-
 		if h.v3.RefcountOrder == 0 || h.v3.RefcountOrder > 6 {
 			exc.Throwf("Bad refcount order %d", h.v3.RefcountOrder)
 		}
@@ -282,16 +298,42 @@ func (h *headerImpl) write() {
 }
 
 func (h *headerImpl) autoclear() {
+	h.Lock()
+	defer h.Unlock()
+
 	if h.v3.AutoclearFeatures&^autoclearKnown == 0 {
 		return
 	}
 	h.write()
 }
 
+func (h *headerImpl) dirty() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.v3.IncompatibleFeatures&featureDirty != 0
+}
+
+func (h *headerImpl) setDirty(dirty bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	// Version 2 has no dirty bit
+	if h.v2.Version < 3 || (h.v3.IncompatibleFeatures&featureDirty != 0) == dirty {
+		return
+	}
+	h.v3.IncompatibleFeatures ^= featureDirty
+	h.write()
+	h.bio.Sync()
+}
+
 func (h *headerImpl) clusterSize() int {
 	return 1 << h.v2.ClusterBits
 }
 
+func (h *headerImpl) clusterBits() int {
+	return int(h.v2.ClusterBits)
+}
+
 func (h *headerImpl) size() int64 {
 	return int64(h.v2.Size)
 }
@@ -301,32 +343,55 @@ func (h *headerImpl) l1Entries() int {
 }
 
 func (h *headerImpl) l1Offset() int64 {
+	h.RLock()
+	defer h.RUnlock()
 	return int64(h.v2.L1TableOffset)
 }
 
+func (h *headerImpl) setL1Offset(offset int64) {
+	h.Lock()
+	defer h.Unlock()
+	h.v2.L1TableOffset = uint64(offset)
+	h.write()
+}
+
 func (h *headerImpl) io() *eio.BinaryIO {
 	return h.bio
 }
 
 func (h *headerImpl) refcountOffset() int64 {
+	h.RLock()
+	defer h.RUnlock()
 	return int64(h.v2.RefcountTableOffset)
 }
 
 func (h *headerImpl) refcountClusters() int {
+	h.RLock()
+	defer h.RUnlock()
 	return int(h.v2.RefcountTableClusters)
 }
 
+func (h *headerImpl) refcountTable() (offset int64, clusters int) {
+	h.RLock()
+	defer h.RUnlock()
+	return int64(h.v2.RefcountTableOffset), int(h.v2.RefcountTableClusters)
+}
+
 func (h *headerImpl) refcountBits() int {
 	return 1 << h.v3.RefcountOrder
 }
 
 func (h *headerImpl) setRefcountTable(offset int64, size int) {
+	h.Lock()
+	defer h.Unlock()
 	h.v2.RefcountTableOffset = uint64(offset)
 	h.v2.RefcountTableClusters = uint32(size)
 	h.write()
 }
 
 func (h *headerImpl) snapshotsOffset() int64 {
+	h.RLock()
+	defer h.RUnlock()
 	return int64(h.v2.SnapshotsOffset)
 }
 
@@ -334,6 +399,23 @@ func (h *headerImpl) snapshotsCount() int {
 	return int(h.v2.NbSnapshots)
 }
 
+func (h *headerImpl) setSnapshotsOffset(offset int64) {
+	h.Lock()
+	defer h.Unlock()
+	h.v2.SnapshotsOffset = uint64(offset)
+	h.write()
+}
+
+func (h *headerImpl) extension(id uint32) []byte {
+	return h.extensions[id]
+}
+
+func (h *headerImpl) autoclearFeatures() uint64 {
+	h.RLock()
+	defer h.RUnlock()
+	return h.v3.AutoclearFeatures
+}
+
 func (h *headerImpl) version() int {
 	return int(h.v2.Version)
 }
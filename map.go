@@ -0,0 +1,181 @@
+package qcow2
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// An Extent is a range of a guest disk, that all has the same allocation status
+type Extent struct {
+	Start  int64
+	Length int64
+
+	// Whether this range is allocated in the image
+	Present bool
+	// Whether this range reads as zeros
+	Zero bool
+	// Whether this range is stored as data in the host file
+	Data bool
+	// Whether the data is compressed
+	Compressed bool
+	// Where the data starts in the host file, or -1 if there is no such offset
+	Offset int64
+}
+
+// Can another extent be merged onto the end of this one?
+func (e *Extent) mergeable(next *Extent) bool {
+	if e.Present != next.Present || e.Zero != next.Zero || e.Data != next.Data ||
+		e.Compressed != next.Compressed {
+		return false
+	}
+	if e.Offset < 0 || next.Offset < 0 {
+		return e.Offset == next.Offset
+	}
+	return e.Offset+e.Length == next.Offset
+}
+
+// Get the extent status for a range in a cluster, given its L2 entry
+func (g *guestImpl) extentByL2(l2 mapEntry, off int) Extent {
+	e := Extent{Offset: -1}
+	hostOff := int64(uint64(l2) & offsetMask)
+	switch {
+	case l2.compressed():
+		e.Present, e.Data, e.Compressed = true, true, true
+	case l2.zero():
+		e.Present, e.Zero = true, true
+		if hostOff != 0 {
+			e.Offset = hostOff + int64(off)
+		}
+	case hostOff != 0:
+		e.Present, e.Data = true, true
+		e.Offset = hostOff + int64(off)
+	default:
+		// Without a backing file, unallocated clusters read as zero
+		e.Zero = true
+	}
+	return e
+}
+
+// Find the extent at a position in the guest, returning its status and end
+func (g *guestImpl) extentAt(pos int64) (e Extent, end int64) {
+	cs := int64(g.clusterSize())
+	idx := pos / cs
+	lock := g.rangeLock(idx)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if g.getL1(idx, false).nil() {
+		// Skip the entire L2 table
+		e = g.extentByL2(0, 0)
+		end = (idx/g.l2Entries() + 1) * g.l2Entries() * cs
+	} else {
+		e = g.extentByL2(g.getL2(idx, false), int(pos%cs))
+		end = (idx + 1) * cs
+	}
+	return
+}
+
+// Finds the extent at a position in a disk, returning its status and end
+type extentFunc func(pos int64) (e Extent, end int64)
+
+// Get the extents in a range of a disk
+func mapExtents(size int64, off int64, length int64, at extentFunc) []Extent {
+	if off < 0 || length < 0 || off+length > size {
+		exc.ThrowOnError(io.ErrUnexpectedEOF)
+	}
+
+	exts := make([]Extent, 0)
+	for pos := off; pos < off+length; {
+		e, end := at(pos)
+		if end > off+length {
+			end = off + length
+		}
+		e.Start, e.Length = pos, end-pos
+		pos = end
+
+		if n := len(exts); n > 0 && exts[n-1].mergeable(&e) {
+			exts[n-1].Length += e.Length
+		} else {
+			exts = append(exts, e)
+		}
+	}
+	return exts
+}
+
+func (g *guestImpl) Map(off int64, length int64) (exts []Extent, err error) {
+	err = eio.BacktraceWrap(func() {
+		exts = mapExtents(g.size, off, length, g.extentAt)
+	})
+	return
+}
+
+// WriteMapJSON writes extents in the same JSON format as `qemu-img map --output=json`
+func WriteMapJSON(w io.Writer, exts []Extent) error {
+	sep := "["
+	for _, e := range exts {
+		_, err := fmt.Fprintf(w, `%s{ "start": %d, "length": %d, "depth": 0, "present": %t, `+
+			`"zero": %t, "data": %t, "compressed": %t`,
+			sep, e.Start, e.Length, e.Present, e.Zero, e.Data, e.Compressed)
+		if err != nil {
+			return err
+		}
+		if e.Offset >= 0 {
+			if _, err = fmt.Fprintf(w, `, "offset": %d`, e.Offset); err != nil {
+				return err
+			}
+		}
+		if _, err = io.WriteString(w, "}"); err != nil {
+			return err
+		}
+		sep = ",\n"
+	}
+	if len(exts) != 0 {
+		sep = ""
+	}
+	_, err := io.WriteString(w, sep+"]\n")
+	return err
+}
+
+// Find the first position at or after off in a disk where the data status
+// matches.
+//
+// Returns -1 if there is none.
+func seekExtents(size int64, off int64, data bool, at extentFunc) int64 {
+	if off < 0 {
+		exc.Throwf("Negative seek offset %d", off)
+	}
+	for pos := off; pos < size; {
+		e, end := at(pos)
+		if e.Data == data {
+			return pos
+		}
+		pos = end
+	}
+	if data || off >= size {
+		return -1
+	}
+	// There's an implicit hole at the end of the disk
+	return size
+}
+
+// Seek for data or a hole, returning io.EOF if there is none
+func seekWrap(size int64, off int64, data bool, at extentFunc) (pos int64, err error) {
+	err = eio.BacktraceWrap(func() {
+		pos = seekExtents(size, off, data, at)
+	})
+	if err == nil && pos < 0 {
+		err = io.EOF
+	}
+	return
+}
+
+func (g *guestImpl) SeekData(off int64) (int64, error) {
+	return seekWrap(g.size, off, true, g.extentAt)
+}
+
+func (g *guestImpl) SeekHole(off int64) (int64, error) {
+	return seekWrap(g.size, off, false, g.extentAt)
+}
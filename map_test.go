@@ -0,0 +1,144 @@
+package qcow2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// Make an image with data in clusters 1 and 2, with 2 then zeroed in place.
+// Cluster 4 is zeroed without allocation.
+func mapImage(tb testing.TB) Guest {
+	q := tempImage(tb, CreateOptions{Size: 1 << 20})
+	g, err := q.Guest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := g.WriteAt(bytes.Repeat([]byte{1}, 2<<16), 1<<16); err != nil {
+		tb.Fatal(err)
+	}
+	if err := g.WriteZeroes(2<<16, 1<<16, false); err != nil {
+		tb.Fatal(err)
+	}
+	if err := g.WriteZeroes(4<<16, 1<<16, true); err != nil {
+		tb.Fatal(err)
+	}
+	return g
+}
+
+// What qemu-img map --output=json prints for an image written the same way
+const mapImageJSON = `[{ "start": 0, "length": 65536, "depth": 0, "present": false, "zero": true, "data": false, "compressed": false},
+{ "start": 65536, "length": 65536, "depth": 0, "present": true, "zero": false, "data": true, "compressed": false, "offset": 327680},
+{ "start": 131072, "length": 65536, "depth": 0, "present": true, "zero": true, "data": false, "compressed": false, "offset": 393216},
+{ "start": 196608, "length": 851968, "depth": 0, "present": false, "zero": true, "data": false, "compressed": false}]
+`
+
+func TestMapJSON(t *testing.T) {
+	g := mapImage(t)
+	defer g.Close()
+	exts, err := g.Map(0, g.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteMapJSON(&buf, exts); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != mapImageJSON {
+		t.Fatal(buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteMapJSON(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "[]\n" {
+		t.Fatal(buf.String())
+	}
+}
+
+func TestMapRange(t *testing.T) {
+	g := mapImage(t)
+	defer g.Close()
+
+	// Partial clusters are trimmed, and offsets adjusted
+	exts, err := g.Map(100000, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Extent{
+		{Start: 100000, Length: 31072, Present: true, Data: true, Offset: 327680 + 100000 - 65536},
+		{Start: 131072, Length: 65536, Present: true, Zero: true, Offset: 393216},
+		{Start: 196608, Length: 3392, Zero: true, Offset: -1},
+	}
+	if len(exts) != len(want) {
+		t.Fatalf("%+v", exts)
+	}
+	for i := range want {
+		if exts[i] != want[i] {
+			t.Fatalf("%+v", exts)
+		}
+	}
+
+	if _, err := g.Map(0, g.Size()+1); err == nil {
+		t.Fatal("Mapped past the end of the disk")
+	}
+}
+
+func TestSeek(t *testing.T) {
+	g := mapImage(t)
+	defer g.Close()
+	size := g.Size()
+	for _, tc := range []struct {
+		data bool
+		off  int64
+		want int64
+	}{
+		{true, 0, 65536},
+		{true, 70000, 70000},
+		{false, 70000, 131072},
+		{false, 0, 0},
+		{false, size - 1, size - 1},
+	} {
+		var pos int64
+		var err error
+		if tc.data {
+			pos, err = g.SeekData(tc.off)
+		} else {
+			pos, err = g.SeekHole(tc.off)
+		}
+		if err != nil || pos != tc.want {
+			t.Fatalf("Seek %t from %d: got %d, %v", tc.data, tc.off, pos, err)
+		}
+	}
+
+	// Zeroed clusters are holes, even if allocated
+	if _, err := g.SeekData(131072); err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := g.SeekHole(size); err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := g.SeekData(-1); err == nil || err == io.EOF {
+		t.Fatal("Seeking from a negative offset didn't fail")
+	}
+}
+
+func TestSeekSkipsL2Tables(t *testing.T) {
+	// Each L2 table covers 512 MB, find data after an empty one
+	q := tempImage(t, CreateOptions{Size: 2 << 30})
+	g, err := q.Guest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err := g.WriteAt([]byte{1}, 1<<30+100); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err := g.SeekData(0); err != nil || pos != 1<<30 {
+		t.Fatal(pos, err)
+	}
+	if pos, err := g.SeekHole(1 << 30); err != nil || pos != 1<<30+1<<16 {
+		t.Fatal(pos, err)
+	}
+}
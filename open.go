@@ -0,0 +1,184 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+	"github.com/vasi/qcow2/vhd"
+	"github.com/vasi/qcow2/vmdk"
+)
+
+// Format is a disk image format
+type Format int
+
+const (
+	// FormatRaw is a plain disk image, with no metadata
+	FormatRaw Format = iota
+	// FormatQcow2 is qcow version 2 or 3
+	FormatQcow2
+	// FormatQcow1 is legacy qcow version 1
+	FormatQcow1
+	// FormatVMDK is a VMware image
+	FormatVMDK
+	// FormatVHD is a Virtual PC or Hyper-V image
+	FormatVHD
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatRaw:
+		return "raw"
+	case FormatQcow2:
+		return "qcow2"
+	case FormatQcow1:
+		return "qcow"
+	case FormatVMDK:
+		return "vmdk"
+	case FormatVHD:
+		return "vpc"
+	}
+	return "unknown"
+}
+
+// Disk is the data of a disk image, of any format
+type Disk interface {
+	io.Closer
+
+	// Read and write at positions
+	eio.ReaderWriterAt
+	// Get the size of this disk
+	Size() int64
+	// Make sure everything written so far is on stable storage, if possible
+	Flush() error
+}
+
+// Read some bytes, or fewer if the file is short
+func readPrefix(r io.ReaderAt, off int64, n int) []byte {
+	buf := make([]byte, n)
+	read, err := r.ReadAt(buf, off)
+	if read < n && err != io.EOF {
+		exc.ThrowOnError(err)
+	}
+	return buf[:read]
+}
+
+// Detect the format of an image
+func probe(rw eio.ReaderWriterAt) Format {
+	head := readPrefix(rw, 0, 512)
+	switch {
+	case len(head) >= 8 && binary.BigEndian.Uint32(head) == magic:
+		if binary.BigEndian.Uint32(head[4:]) == 1 {
+			return FormatQcow1
+		}
+		return FormatQcow2
+	case bytes.HasPrefix(head, []byte("KDMV")),
+		bytes.HasPrefix(head, []byte("# Disk DescriptorFile")):
+		return FormatVMDK
+	case bytes.HasPrefix(head, []byte("conectix")):
+		return FormatVHD
+	}
+
+	// Fixed VHDs only have a footer
+	if size, ok := eio.NewIO(rw, binary.BigEndian).Size(); ok && size >= 512 {
+		if bytes.HasPrefix(readPrefix(rw, size-512, 8), []byte("conectix")) {
+			return FormatVHD
+		}
+	}
+	return FormatRaw
+}
+
+// Probe detects the format of a disk image. Unrecognized images are raw.
+func Probe(rw eio.ReaderWriterAt) (f Format, err error) {
+	err = eio.BacktraceWrap(func() {
+		f = probe(rw)
+	})
+	return
+}
+
+// A qcow2 guest, that closes its file when done
+type qcow2Disk struct {
+	Guest
+	q Qcow2
+}
+
+func (d *qcow2Disk) Close() error {
+	err := d.Guest.Close()
+	if qerr := d.q.Close(); err == nil {
+		err = qerr
+	}
+	return err
+}
+
+// A raw image
+type rawDisk struct {
+	eio.ReaderWriterAt
+	size int64
+}
+
+func (d *rawDisk) Size() int64 {
+	return d.size
+}
+
+// Write within the disk, which can't grow
+func (d *rawDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > d.size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return d.ReaderWriterAt.WriteAt(p, off)
+}
+
+func (d *rawDisk) Close() error {
+	return nil
+}
+
+func (d *rawDisk) Flush() error {
+	return eio.BacktraceWrap(func() {
+		eio.NewIO(d.ReaderWriterAt, binary.BigEndian).Sync()
+	})
+}
+
+// Open a disk image of any format
+func openAny(rw eio.ReaderWriterAt) (Disk, Format) {
+	f := probe(rw)
+	switch f {
+	case FormatQcow2:
+		q, err := Open(rw)
+		exc.ThrowOnError(err)
+		g, err := q.Guest()
+		if err != nil {
+			q.Close()
+			exc.ThrowOnError(err)
+		}
+		return &qcow2Disk{g, q}, f
+	case FormatQcow1:
+		g, err := OpenQcow1(rw)
+		exc.ThrowOnError(err)
+		return g, f
+	case FormatVMDK:
+		d, err := vmdk.Open(rw)
+		exc.ThrowOnError(err)
+		return d, f
+	case FormatVHD:
+		d, err := vhd.Open(rw)
+		exc.ThrowOnError(err)
+		return d, f
+	}
+
+	size, ok := eio.NewIO(rw, binary.BigEndian).Size()
+	if !ok {
+		exc.Throwf("Can't determine the size of a raw image")
+	}
+	return &rawDisk{rw, size}, f
+}
+
+// OpenAny opens a disk image, detecting its format. Unrecognized images are
+// treated as raw.
+func OpenAny(rw eio.ReaderWriterAt) (d Disk, f Format, err error) {
+	err = eio.BacktraceWrap(func() {
+		d, f = openAny(rw)
+	})
+	return
+}
@@ -0,0 +1,171 @@
+package qcow2
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/vasi/qcow2/vhd"
+	"github.com/vasi/qcow2/vmdk"
+)
+
+func TestOpenAnyRawBounds(t *testing.T) {
+	f := tempFile(t)
+	if err := f.Truncate(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	d, format, err := OpenAny(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != FormatRaw {
+		t.Fatalf("Detected format %v", format)
+	}
+	if _, err := d.WriteAt(make([]byte, 512), d.Size()-512); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{d.Size() - 511, d.Size(), -1} {
+		if _, err := d.WriteAt(make([]byte, 512), off); err != io.ErrUnexpectedEOF {
+			t.Fatalf("Write at %d: %v", off, err)
+		}
+	}
+	if fi, _ := f.Stat(); fi.Size() != 1<<20 {
+		t.Fatal("Raw disk grew")
+	}
+}
+
+// Make an image of some format, with the given data at the start
+func openImage(tb testing.TB, format Format, fixed bool, data []byte) *os.File {
+	f := tempFile(tb)
+	const size = 4 << 20
+	var d interface {
+		WriteAt(p []byte, off int64) (int, error)
+	}
+	var err error
+	switch format {
+	case FormatRaw:
+		err = f.Truncate(size)
+		d = f
+	case FormatQcow2:
+		var q Qcow2
+		if q, err = Create(f, CreateOptions{Size: size}); err == nil {
+			defer q.Close()
+			var g Guest
+			if g, err = q.Guest(); err == nil {
+				defer g.Close()
+				d = g
+			}
+		}
+	case FormatVMDK:
+		d, err = vmdk.Create(f, vmdk.CreateOptions{Size: size})
+	case FormatVHD:
+		t := vhd.Dynamic
+		if fixed {
+			t = vhd.Fixed
+		}
+		d, err = vhd.Create(f, vhd.CreateOptions{Size: size, Type: t})
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := d.WriteAt(data, 0); err != nil {
+		tb.Fatal(err)
+	}
+	return f
+}
+
+func TestOpenAny(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, tc := range []struct {
+		format Format
+		fixed  bool
+		name   string
+	}{
+		{FormatRaw, false, "raw"},
+		{FormatQcow2, false, "qcow2"},
+		{FormatVMDK, false, "vmdk"},
+		{FormatVHD, false, "vpc"},
+		{FormatVHD, true, "vpc"},
+	} {
+		f := openImage(t, tc.format, tc.fixed, data)
+		if format, err := Probe(f); err != nil || format != tc.format {
+			t.Fatalf("Probed %v as %v, %v", tc.format, format, err)
+		}
+		if tc.format.String() != tc.name {
+			t.Fatalf("Format %d is named %s", tc.format, tc.format)
+		}
+
+		// Write more data, and read it all back after reopening
+		d, _, err := OpenAny(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Size() != 4<<20 {
+			t.Fatalf("%v has size %d", tc.format, d.Size())
+		}
+		if _, err := d.WriteAt(data, 2<<20); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		d, format, err := OpenAny(f)
+		if err != nil || format != tc.format {
+			t.Fatalf("Opened %v as %v, %v", tc.format, format, err)
+		}
+		got := make([]byte, len(data))
+		for _, off := range []int64{0, 2 << 20} {
+			if _, err := d.ReadAt(got, off); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%v data at %d doesn't match", tc.format, off)
+			}
+		}
+		d.Close()
+	}
+}
+
+func TestOpenAnyQcow(t *testing.T) {
+	f, data := qcow1Image(t)
+	d, format, err := OpenAny(f)
+	if err != nil || format != FormatQcow1 || format.String() != "qcow" {
+		t.Fatal(format, err)
+	}
+	got := make([]byte, len(data))
+	if _, err := d.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data doesn't match")
+	}
+}
+
+func TestOpenAnyUnusual(t *testing.T) {
+	// An empty file is an empty raw disk
+	d, format, err := OpenAny(tempFile(t))
+	if err != nil || format != FormatRaw || d.Size() != 0 {
+		t.Fatal(format, err)
+	}
+
+	// A VMDK descriptor is recognized, but can't be opened
+	f := tempFile(t)
+	f.WriteAt([]byte("# Disk DescriptorFile\n"), 0)
+	if format, err := Probe(f); err != nil || format != FormatVMDK {
+		t.Fatal(format, err)
+	}
+	if _, _, err := OpenAny(f); err == nil {
+		t.Fatal("Opened a VMDK descriptor")
+	}
+
+	// A bad qcow2 file fails, rather than being treated as raw
+	f = tempFile(t)
+	f.WriteAt([]byte{'Q', 'F', 'I', 0xfb, 0, 0, 0, 9}, 0)
+	if _, _, err := OpenAny(f); err == nil {
+		t.Fatal("Opened a bad qcow2 file")
+	}
+}
@@ -0,0 +1,74 @@
+package qcow2
+
+import (
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// Preallocation controls how much space is allocated for a guest disk up front.
+// It only applies when an image is created. Growing an image isn't supported,
+// so there is no preallocation on resize.
+type Preallocation int
+
+const (
+	// PreallocOff allocates clusters only as they're written.
+	PreallocOff Preallocation = iota
+	// PreallocMetadata allocates every L2 table, and maps every guest cluster
+	// to a host cluster, without writing the data. Guest offsets map linearly
+	// to host offsets.
+	PreallocMetadata
+	// PreallocFalloc is like PreallocMetadata, but also reserves host space
+	// for the data. The storage must support this.
+	PreallocFalloc
+	// PreallocFull is like PreallocMetadata, but also writes zeros to the data.
+	PreallocFull
+)
+
+// Map every guest cluster to a host cluster, with the data following the L2
+// tables contiguously. The guest must not have any tables yet.
+func (q *qcow2) preallocate(mode Preallocation) {
+	h := q.header
+	cs := int64(h.clusterSize())
+	clusters := eio.DivCeil(h.size(), cs)
+	if mode == PreallocOff || clusters == 0 {
+		return
+	}
+
+	r := q.refcounts()
+	l2Entries := cs / 8
+	tables := eio.DivCeil(clusters, l2Entries)
+	l2Start := r.allocate(tables, AllocAppend)
+	dataStart := r.allocate(clusters, AllocAppend)
+	// The refcounts must be on disk before the tables that use them
+	r.close()
+
+	dataOff, dataSize := dataStart*cs, clusters*cs
+	switch mode {
+	case PreallocFull:
+		h.io().Zero(dataOff, int(dataSize))
+	case PreallocFalloc:
+		if !h.io().Allocate(dataOff, dataSize) {
+			exc.Throwf("Storage doesn't support reserving space")
+		}
+	}
+	if size, ok := h.io().Size(); !ok || size < dataOff+dataSize {
+		if !h.io().Truncate(dataOff + dataSize) {
+			// Extend the file by writing a final zero
+			h.io().WriteAt(dataOff+dataSize-1, []byte{0})
+		}
+	}
+
+	// Write the L2 tables, then point the L1 table at them
+	table := make([]byte, cs)
+	for t := int64(0); t < tables; t++ {
+		eio.ZeroFill(table)
+		for i := int64(0); i < l2Entries && t*l2Entries+i < clusters; i++ {
+			e := uint64(dataOff+(t*l2Entries+i)*cs) | noCow
+			h.io().ByteOrder().PutUint64(table[i*8:], e)
+		}
+		h.io().WriteAt((l2Start+t)*cs, table)
+	}
+	for t := int64(0); t < tables; t++ {
+		h.io().WriteUint64(h.l1Offset()+t*8, uint64((l2Start+t)*cs)|noCow)
+	}
+}
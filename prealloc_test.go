@@ -0,0 +1,74 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// Hides the type of a file, so it can't reserve space
+type plainFile struct {
+	*os.File
+}
+
+func TestPreallocation(t *testing.T) {
+	const size = 3<<20 + 1000
+	for _, mode := range []Preallocation{PreallocOff, PreallocMetadata, PreallocFalloc, PreallocFull} {
+		f := tempFile(t)
+		q, err := Create(f, CreateOptions{Size: size, ClusterBits: 12, Preallocation: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		requireClean(t, q)
+
+		// Every cluster is mapped linearly, unless preallocation is off
+		g, err := q.Guest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exts, err := g.Map(0, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(exts) != 1 || exts[0].Data != (mode != PreallocOff) {
+			t.Fatalf("Mode %d: %+v", mode, exts)
+		}
+		// The file ends with the last, partial, guest cluster
+		fi, _ := f.Stat()
+		if mode != PreallocOff && fi.Size() != exts[0].Offset+(size+4095)&^4095 {
+			t.Fatalf("Mode %d: file size %d, data at %d", mode, fi.Size(), exts[0].Offset)
+		}
+
+		// Writing doesn't allocate anything more
+		data := bytes.Repeat([]byte{1}, 100000)
+		if _, err := g.WriteAt(data, size-int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if after, _ := f.Stat(); mode != PreallocOff && after.Size() != fi.Size() {
+			t.Fatalf("Mode %d: file grew from %d to %d", mode, fi.Size(), after.Size())
+		}
+		requireClean(t, q)
+		q.Close()
+	}
+}
+
+func TestPreallocationErrors(t *testing.T) {
+	_, err := Create(plainFile{tempFile(t)}, CreateOptions{Size: 1 << 20, Preallocation: PreallocFalloc})
+	if err == nil {
+		t.Fatal("Reserved space on storage that doesn't support it")
+	}
+	_, err = Create(tempFile(t), CreateOptions{Size: 1 << 20, Preallocation: PreallocFull + 1})
+	if err == nil {
+		t.Fatal("Created with an invalid preallocation mode")
+	}
+
+	// Empty disks need nothing
+	q, err := Create(tempFile(t), CreateOptions{Preallocation: PreallocFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireClean(t, q)
+}
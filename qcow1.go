@@ -0,0 +1,208 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// The header of a qcow version 1 file
+type qcow1Header struct {
+	Magic             uint32
+	Version           uint32
+	BackingFileOffset uint64
+	BackingFileSize   uint32
+	MTime             uint32
+	Size              uint64
+	ClusterBits       uint8
+	L2Bits            uint8
+	Padding           uint16
+	CryptMethod       uint32
+	L1TableOffset     uint64
+}
+
+// Compressed flag for qcow version 1 L2 entries
+const qcow1Compressed uint64 = 1 << 63
+
+// A read-only guest of a qcow version 1 file
+type qcow1Guest struct {
+	r      io.ReaderAt
+	header qcow1Header
+	l1     []uint64
+}
+
+// Read data from the file, or throw
+func (q *qcow1Guest) read(off int64, data interface{}) {
+	exc.ThrowOnError(binary.Read(io.NewSectionReader(q.r, off, int64(binary.Size(data))),
+		binary.BigEndian, data))
+}
+
+func (q *qcow1Guest) open(r io.ReaderAt) {
+	q.r = r
+	q.read(0, &q.header)
+	h := &q.header
+	if h.Magic != magic {
+		exc.Throwf("Not a qcow file")
+	}
+	if h.Version != 1 {
+		exc.Throwf("Unsupported qcow format version %d", h.Version)
+	}
+	if h.ClusterBits < 9 || h.ClusterBits > 16 {
+		exc.Throwf("Invalid qcow cluster bits %d", h.ClusterBits)
+	}
+	if h.L2Bits < 9-3 || h.L2Bits > 16-3 {
+		exc.Throwf("Invalid qcow L2 bits %d", h.L2Bits)
+	}
+	if h.BackingFileOffset != 0 {
+		exc.Throwf("Backing files are not supported")
+	}
+	if h.CryptMethod != 0 {
+		exc.Throwf("Encryption is not supported")
+	}
+
+	l1Entries := eio.DivCeil(int64(h.Size), int64(1)<<(h.ClusterBits+h.L2Bits))
+	q.l1 = make([]uint64, l1Entries)
+	q.read(int64(h.L1TableOffset), q.l1)
+}
+
+func (q *qcow1Guest) clusterSize() int64 {
+	return 1 << q.header.ClusterBits
+}
+
+// Get the L2 entry for a cluster, or zero if there's no L2 table
+func (q *qcow1Guest) entry(idx int64) uint64 {
+	l2 := q.l1[idx>>q.header.L2Bits]
+	if l2 == 0 {
+		return 0
+	}
+	var e uint64
+	q.read(int64(l2)+(idx&(1<<q.header.L2Bits-1))*8, &e)
+	return e
+}
+
+// Where is the data for an L2 entry, and how big is it if compressed?
+func (q *qcow1Guest) location(e uint64) (off int64, size int64) {
+	if e&qcow1Compressed == 0 {
+		return int64(e), 0
+	}
+	shift := 63 - uint(q.header.ClusterBits)
+	return int64(e & (1<<shift - 1)), int64(e>>shift) & (q.clusterSize() - 1)
+}
+
+// Read a segment of a cluster
+func (q *qcow1Guest) readCluster(p []byte, idx int64, off int64) {
+	e := q.entry(idx)
+	loc, size := q.location(e)
+	switch {
+	case e == 0:
+		eio.ZeroFill(p)
+	case e&qcow1Compressed != 0:
+		z := make([]byte, size)
+		if n, err := q.r.ReadAt(z, loc); n < len(z) {
+			exc.ThrowOnError(err)
+		}
+		copy(p, decompressCluster(z, int(q.clusterSize()))[off:])
+	default:
+		if n, err := q.r.ReadAt(p, loc+off); n < len(p) {
+			exc.ThrowOnError(err)
+		}
+	}
+}
+
+func (q *qcow1Guest) extentAt(pos int64) (e Extent, end int64) {
+	cs := q.clusterSize()
+	idx := pos / cs
+	end = (idx + 1) * cs
+	e = Extent{Offset: -1}
+
+	entry := q.entry(idx)
+	loc, _ := q.location(entry)
+	switch {
+	case entry == 0:
+		e.Zero = true
+	case entry&qcow1Compressed != 0:
+		e.Present, e.Data, e.Compressed = true, true, true
+	default:
+		e.Present, e.Data = true, true
+		e.Offset = loc + pos%cs
+	}
+	return
+}
+
+func (q *qcow1Guest) Size() int64 {
+	return int64(q.header.Size)
+}
+
+func (q *qcow1Guest) Close() error {
+	return nil
+}
+
+// Nothing to flush, since we're read-only
+func (q *qcow1Guest) Flush() error {
+	return nil
+}
+
+func (q *qcow1Guest) ReadAt(p []byte, off int64) (n int, err error) {
+	err = eio.BacktraceWrap(func() {
+		if off < 0 || off+int64(len(p)) > q.Size() {
+			exc.ThrowOnError(io.ErrUnexpectedEOF)
+		}
+		cs := q.clusterSize()
+		for len(p) > 0 {
+			idx, coff := off/cs, off%cs
+			length := cs - coff
+			if length > int64(len(p)) {
+				length = int64(len(p))
+			}
+			q.readCluster(p[:length], idx, coff)
+			p = p[length:]
+			off += length
+			n += int(length)
+		}
+	})
+	return
+}
+
+// Fail to write
+func (q *qcow1Guest) readOnly() error {
+	return &ReadOnlyError{"qcow version 1 images are read-only"}
+}
+
+func (q *qcow1Guest) WriteAt(p []byte, off int64) (int, error) {
+	return 0, q.readOnly()
+}
+
+func (q *qcow1Guest) Discard(off int64, length int64) error {
+	return q.readOnly()
+}
+
+func (q *qcow1Guest) WriteZeroes(off int64, length int64, mayUnmap bool) error {
+	return q.readOnly()
+}
+
+func (q *qcow1Guest) Map(off int64, length int64) (exts []Extent, err error) {
+	err = eio.BacktraceWrap(func() {
+		exts = mapExtents(q.Size(), off, length, q.extentAt)
+	})
+	return
+}
+
+func (q *qcow1Guest) SeekData(off int64) (int64, error) {
+	return seekWrap(q.Size(), off, true, q.extentAt)
+}
+
+func (q *qcow1Guest) SeekHole(off int64) (int64, error) {
+	return seekWrap(q.Size(), off, false, q.extentAt)
+}
+
+// OpenQcow1 opens a legacy qcow version 1 file. Its guest is read-only.
+func OpenQcow1(r io.ReaderAt) (g Guest, err error) {
+	err = eio.BacktraceWrap(func() {
+		q := &qcow1Guest{}
+		q.open(r)
+		g = q
+	})
+	return
+}
@@ -0,0 +1,143 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/vasi/qcow2/eio"
+)
+
+// Write a qcow version 1 file with 4 KB clusters and a 4 MB guest. Guest
+// cluster 0 holds random data, cluster 1 is compressed, and the rest is
+// unallocated. Returns the file and the guest data.
+func qcow1Image(tb testing.TB) (*os.File, []byte) {
+	const (
+		cs       = 4096
+		l1Offset = 64
+		l2Offset = cs
+		raw      = 2 * cs
+		packed   = 3 * cs
+	)
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data[:cs])
+	copy(data[cs:2*cs], bytes.Repeat([]byte("qcow1"), cs))
+	z := compressCluster(data[cs : 2*cs])
+
+	f := tempFile(tb)
+	bio := eio.NewIO(f, binary.BigEndian)
+	w := eio.NewSequentialWriter(bio, 0)
+	w.WriteData(qcow1Header{
+		Magic:         magic,
+		Version:       1,
+		Size:          uint64(len(data)),
+		ClusterBits:   12,
+		L2Bits:        9,
+		L1TableOffset: l1Offset,
+	})
+	w.Commit()
+	bio.WriteUint64(l1Offset, l2Offset)
+	bio.WriteUint64(l2Offset, raw)
+	bio.WriteUint64(l2Offset+8, qcow1Compressed|uint64(len(z))<<(63-12)|packed)
+	bio.WriteAt(raw, data[:cs])
+	bio.WriteAt(packed, z)
+	return f, data
+}
+
+func TestQcow1Read(t *testing.T) {
+	f, data := qcow1Image(t)
+	g, err := OpenQcow1(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if g.Size() != int64(len(data)) {
+		t.Fatalf("Size %d", g.Size())
+	}
+	got := make([]byte, len(data))
+	if _, err := g.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data doesn't match")
+	}
+
+	// Reads within the compressed cluster
+	p := make([]byte, 100)
+	if _, err := g.ReadAt(p, 4096+1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[4096+1000:4096+1100]) {
+		t.Fatal("Partial read doesn't match")
+	}
+	if _, err := g.ReadAt(p, g.Size()-1); err == nil {
+		t.Fatal("Read past the end of the disk")
+	}
+}
+
+func TestQcow1Map(t *testing.T) {
+	f, data := qcow1Image(t)
+	g, err := OpenQcow1(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exts, err := g.Map(0, g.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Extent{
+		{Start: 0, Length: 4096, Present: true, Data: true, Offset: 2 * 4096},
+		{Start: 4096, Length: 4096, Present: true, Data: true, Compressed: true, Offset: -1},
+		{Start: 8192, Length: int64(len(data)) - 8192, Zero: true, Offset: -1},
+	}
+	if len(exts) != len(want) {
+		t.Fatalf("%+v", exts)
+	}
+	for i := range want {
+		if exts[i] != want[i] {
+			t.Fatalf("%+v", exts)
+		}
+	}
+	if pos, err := g.SeekHole(0); err != nil || pos != 8192 {
+		t.Fatal(pos, err)
+	}
+	if _, err := g.SeekData(8192); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestQcow1ReadOnly(t *testing.T) {
+	f, _ := qcow1Image(t)
+	g, err := OpenQcow1(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.WriteAt([]byte{1}, 0); err == nil {
+		t.Fatal("Wrote to a qcow1 image")
+	} else if _, ok := err.(*ReadOnlyError); !ok {
+		t.Fatal(err)
+	}
+	if err := g.Discard(0, 4096); err == nil {
+		t.Fatal("Discarded from a qcow1 image")
+	}
+	if err := g.WriteZeroes(0, 4096, true); err == nil {
+		t.Fatal("Zeroed a qcow1 image")
+	}
+}
+
+func TestQcow1Unsupported(t *testing.T) {
+	for name, off := range map[string]int64{
+		"version":    4,
+		"backing":    8,
+		"encryption": 36,
+	} {
+		f, _ := qcow1Image(t)
+		f.WriteAt([]byte{0, 0, 0, 2}, off)
+		if _, err := OpenQcow1(f); err == nil {
+			t.Fatalf("Opened with unsupported %s", name)
+		}
+	}
+}
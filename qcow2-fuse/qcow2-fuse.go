@@ -13,8 +13,10 @@ import (
 	"golang.org/x/net/context"
 )
 
+// TODO(user-034b): Answer lseek SEEK_DATA/SEEK_HOLE with Guest.SeekData and
+// SeekHole, once bazil.org/fuse can deliver FUSE_LSEEK requests. See TODO.txt.
 type file struct {
-	guest qcow2.Guest
+	guest qcow2.Disk
 }
 
 func (f file) Attr(ctx context.Context, a *fuse.Attr) error {
@@ -41,11 +43,28 @@ func (f file) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Writ
 	return err
 }
 
+func (f file) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	err := f.guest.Flush()
+	if err != nil {
+		log.Print(err)
+	}
+	return err
+}
+
+func (f file) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	err := f.guest.Flush()
+	if err != nil {
+		log.Print(err)
+	}
+	return err
+}
+
 func main() {
 	filename := os.Args[1]
 
 	dstname := filepath.Base(filename)
-	if filepath.Ext(dstname) == ".qcow2" {
+	switch filepath.Ext(dstname) {
+	case ".qcow2", ".qcow", ".vmdk", ".vhd":
 		dstname = strings.TrimSuffix(dstname, filepath.Ext(dstname))
 	}
 
@@ -55,17 +74,11 @@ func main() {
 	}
 	defer f.Close()
 
-	q, err := qcow2.Open(f)
+	guest, _, err := qcow2.OpenAny(f)
 	if err != nil {
 		eio.Trace(err)
 		log.Fatal(err)
 	}
-	defer q.Close()
-
-	guest, err := q.Guest()
-	if err != nil {
-		log.Fatal(err)
-	}
 	defer guest.Close()
 
 	conn, err := fuse.Mount(
@@ -2,51 +2,226 @@ package qcow2
 
 import (
 	"io"
+	"sync"
 
+	"github.com/timtadh/data-structures/exc"
 	"github.com/vasi/qcow2/eio"
 )
 
 // Qcow2 represents a qcow2 file
 type Qcow2 interface {
+	// Close writes out the metadata cached by open guests, syncs the file if
+	// possible, and then clears the dirty bit.
 	io.Closer
 
 	Version() int
 
 	Guest() (Guest, error)
+	GuestWithOptions(opts GuestOptions) (Guest, error)
 	ClusterSize() int
 
 	Snapshots() ([]Snapshot, error)
+
+	// Check the consistency of the file, and optionally repair it. I/O by
+	// open guests waits until the check is done.
+	Check(mode RepairMode) (*CheckResult, error)
+	// The result of checking the file when it was opened, because it wasn't
+	// closed cleanly. Nil if it was closed cleanly.
+	Recovery() *CheckResult
+	// Move data to fill free space, and shrink the file. No guests may be open.
+	Compact(progress ProgressFunc) error
+	// Reorder data so guest order matches host order. No guests may be open.
+	Defrag(progress ProgressFunc) (*DefragResult, error)
 }
 
 type qcow2 struct {
 	header header
+	// Whether we were opened with OpenReadOnly
+	readOnly bool
+	// Shared by all users, so they see the same cached refcounts
+	rc refcounts
+	// What we found when opening a file that wasn't closed cleanly
+	recovery *CheckResult
+
+	// Guests that are still open, which must be flushed when we close
+	guests     map[*guestImpl]bool
+	guestsLock sync.Mutex
+	// State shared by open guests, or nil if there are none
+	shared *guestShared
+}
+
+// ReadOnlyError is returned when trying to change an image that can't be
+// written.
+type ReadOnlyError struct {
+	Reason string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return e.Reason
+}
+
+// The error for changing an image opened with OpenReadOnly
+var errOpenedReadOnly = &ReadOnlyError{"qcow2 image was opened read-only"}
+
+// Storage that refuses writes, so a read-only image can't be changed by
+// accident
+type readOnlyFile struct {
+	io.ReaderAt
+}
+
+func (f readOnlyFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errOpenedReadOnly
 }
 
-// Open a qcow2 file
+// OpenOptions control how a qcow2 file is opened
+type OpenOptions struct {
+	// Which problems to repair if the file wasn't closed cleanly. A crash
+	// should leave at most leaked clusters. With CheckOnly, the file is
+	// checked but not changed. Either way, the result is available from
+	// Recovery.
+	Recover RepairMode
+}
+
+// Open a qcow2 file. If it wasn't closed cleanly, leaked clusters are repaired.
 func Open(rw eio.ReaderWriterAt) (q Qcow2, err error) {
+	return OpenWithOptions(rw, OpenOptions{Recover: RepairLeaks})
+}
+
+// OpenWithOptions opens a qcow2 file, with control over how it's opened
+func OpenWithOptions(rw eio.ReaderWriterAt, opts OpenOptions) (q Qcow2, err error) {
 	var qi *qcow2
 	err = eio.BacktraceWrap(func() {
 		qi = &qcow2{}
 		qi.header = &headerImpl{}
 		qi.header.open(rw)
+		if qi.header.dirty() {
+			qi.recover(opts.Recover)
+		}
+	})
+	return qi, err
+}
+
+// OpenReadOnly opens a qcow2 file without ever writing to it. Attempts to
+// change the image fail with a *ReadOnlyError.
+//
+// If the file wasn't closed cleanly, its refcounts aren't repaired. That
+// doesn't affect reading guest data.
+func OpenReadOnly(r io.ReaderAt) (q Qcow2, err error) {
+	var qi *qcow2
+	err = eio.BacktraceWrap(func() {
+		qi = &qcow2{readOnly: true}
+		qi.header = &headerImpl{}
+		qi.header.open(readOnlyFile{r})
 	})
 	return qi, err
 }
 
+// Check a file that wasn't closed cleanly, and repair it as requested. It's
+// only marked clean if no problems remain.
+func (q *qcow2) recover(mode RepairMode) {
+	r := q.refcounts()
+	q.recovery = newChecker(q.header, r).repair(mode)
+	r.close()
+	if mode != CheckOnly && q.recovery.Clean() {
+		q.header.io().Sync()
+		q.header.setDirty(false)
+	}
+}
+
+func (q *qcow2) Recovery() *CheckResult {
+	return q.recovery
+}
+
 func (q *qcow2) Guest() (g Guest, err error) {
+	return q.GuestWithOptions(GuestOptions{})
+}
+
+func (q *qcow2) GuestWithOptions(opts GuestOptions) (g Guest, err error) {
 	err = eio.BacktraceWrap(func() {
-		g = &guestImpl{}
-		g.open(q.header, q.refcounts(), q.header.l1Offset(), q.header.size())
+		g = q.guest(opts)
 	})
 	return
 }
 
+func (q *qcow2) guest(opts GuestOptions) *guestImpl {
+	q.guestsLock.Lock()
+	defer q.guestsLock.Unlock()
+	if q.guests == nil {
+		q.guests = make(map[*guestImpl]bool)
+	}
+	if q.shared == nil {
+		q.shared = newGuestShared(q.header, opts.CacheSize)
+	}
+
+	g := &guestImpl{options: opts, owner: q, readOnly: q.readOnly}
+	g.open(q.header, q.refcounts(), q.shared, q.header.l1Offset(), q.header.size())
+	q.guests[g] = true
+	return g
+}
+
+// Fail if any guests are open, since they cache metadata that's about to move
+func (q *qcow2) requireNoGuests(op string) {
+	q.guestsLock.Lock()
+	defer q.guestsLock.Unlock()
+	if len(q.guests) > 0 {
+		exc.Throwf("Can't %s while %d guests are open", op, len(q.guests))
+	}
+}
+
+// Block I/O by open guests, and write out and forget the tables they cache,
+// so the file can be examined and changed directly. Returns a function that
+// lets them continue.
+func (q *qcow2) pauseGuests() func() {
+	q.guestsLock.Lock()
+	s := q.shared
+	if s == nil {
+		return q.guestsLock.Unlock
+	}
+
+	for i := range s.rangeLocks {
+		s.rangeLocks[i].Lock()
+	}
+	s.tables.invalidate()
+	return func() {
+		for i := range s.rangeLocks {
+			s.rangeLocks[i].Unlock()
+		}
+		q.guestsLock.Unlock()
+	}
+}
+
+// Stop tracking a guest, because it's closed
+func (q *qcow2) guestClosed(g *guestImpl) {
+	q.guestsLock.Lock()
+	defer q.guestsLock.Unlock()
+	delete(q.guests, g)
+	if len(q.guests) == 0 {
+		// Others may move the tables once no guests are open, so don't
+		// keep them cached
+		q.shared = nil
+	}
+}
+
 func (q *qcow2) ClusterSize() int {
 	return q.header.clusterSize()
 }
 
 func (q *qcow2) Close() error {
-	return nil
+	if q.readOnly {
+		return nil
+	}
+	return eio.BacktraceWrap(func() {
+		q.guestsLock.Lock()
+		for g := range q.guests {
+			g.flush()
+		}
+		q.guestsLock.Unlock()
+
+		q.refcounts().close()
+		q.header.io().Sync()
+		q.header.setDirty(false)
+		q.header.close()
+	})
 }
 
 func (q *qcow2) Snapshots() (snaps []Snapshot, err error) {
@@ -56,10 +231,67 @@ func (q *qcow2) Snapshots() (snaps []Snapshot, err error) {
 	return
 }
 
+func (q *qcow2) Check(mode RepairMode) (res *CheckResult, err error) {
+	if q.readOnly && mode != CheckOnly {
+		return nil, errOpenedReadOnly
+	}
+	err = eio.BacktraceWrap(func() {
+		defer q.pauseGuests()()
+		r := q.refcounts()
+		defer r.close()
+		// Look at what's actually in the file
+		r.invalidate()
+		res = newChecker(q.header, r).repair(mode)
+	})
+	return
+}
+
+func (q *qcow2) Compact(progress ProgressFunc) error {
+	if q.readOnly {
+		return errOpenedReadOnly
+	}
+	return eio.BacktraceWrap(func() {
+		q.requireNoGuests("compact")
+		r := q.refcounts()
+		defer r.close()
+		// Look at what's actually in the file
+		r.invalidate()
+
+		res := newChecker(q.header, r).repair(RepairLeaks)
+		if res.Corruptions > 0 {
+			exc.Throwf("Can't compact a file with %d errors", res.Corruptions)
+		}
+		newCompactor(q.header, r, progress).compact()
+	})
+}
+
+func (q *qcow2) Defrag(progress ProgressFunc) (res *DefragResult, err error) {
+	if q.readOnly {
+		return nil, errOpenedReadOnly
+	}
+	err = eio.BacktraceWrap(func() {
+		q.requireNoGuests("defragment")
+		r := q.refcounts()
+		defer r.close()
+		// Look at what's actually in the file
+		r.invalidate()
+
+		check := newChecker(q.header, r).repair(RepairLeaks)
+		if check.Corruptions > 0 {
+			exc.Throwf("Can't defragment a file with %d errors", check.Corruptions)
+		}
+		res = newCompactor(q.header, r, progress).defrag()
+	})
+	return
+}
+
 func (q *qcow2) refcounts() refcounts {
-	r := &refcountsImpl{}
-	r.open(q.header)
-	return r
+	if q.rc == nil {
+		r := &refcountsImpl{}
+		r.open(q.header)
+		q.rc = r
+	}
+	return q.rc
 }
 
 func (q *qcow2) Version() int {
@@ -0,0 +1,263 @@
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// Leave a file dirty with a leaked cluster, as if the guest crashed. Returns
+// the contents of the file.
+func leaveDirty(tb testing.TB, q Qcow2) []byte {
+	g, err := q.Guest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := g.WriteAt(make([]byte, 1<<20), 0); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := g.WriteAt([]byte{1}, 0); err != nil {
+		tb.Fatal(err)
+	}
+	if err := g.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+
+	// Leak a cluster
+	qi := q.(*qcow2)
+	r := qi.refcounts()
+	r.allocate(1, AllocAppend)
+	r.flush()
+	if !qi.header.dirty() {
+		tb.Fatal("Writing didn't mark the file dirty")
+	}
+	return fileContents(tb, q)
+}
+
+func fileContents(tb testing.TB, q Qcow2) []byte {
+	bio := q.(*qcow2).header.io()
+	size, ok := bio.Size()
+	if !ok {
+		tb.Fatal("Unknown file size")
+	}
+	buf := make([]byte, size)
+	bio.ReadAt(0, buf)
+	return buf
+}
+
+func TestOpenDirtyCheckOnly(t *testing.T) {
+	f := tempFile(t)
+	q, err := Create(f, CreateOptions{Size: 4 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := leaveDirty(t, q)
+
+	q2, err := OpenWithOptions(f, OpenOptions{Recover: CheckOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := q2.Recovery()
+	if res == nil || res.Leaks != 1 || res.LeaksFixed != 0 {
+		t.Fatalf("%+v", res)
+	}
+	if !bytes.Equal(before, fileContents(t, q2)) {
+		t.Fatal("Checking on open changed the file")
+	}
+}
+
+func TestOpenDirtyRepairsLeaks(t *testing.T) {
+	f := tempFile(t)
+	q, err := Create(f, CreateOptions{Size: 4 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaveDirty(t, q)
+
+	q2, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := q2.Recovery()
+	if res == nil || res.LeaksFixed != 1 || !res.Clean() {
+		t.Fatalf("%+v", res)
+	}
+	if q2.(*qcow2).header.dirty() {
+		t.Fatal("Still dirty after repair")
+	}
+	requireClean(t, q2)
+	if err := q2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once it's clean, there's nothing to recover
+	q3, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q3.Recovery() != nil {
+		t.Fatal("Recovered a clean file")
+	}
+}
+
+func TestOpenDirtyKeepsCorruption(t *testing.T) {
+	f := tempFile(t)
+	q, err := Create(f, CreateOptions{Size: 4 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaveDirty(t, q)
+
+	// Drop the refcount of the L1 table, which only a full repair can fix
+	qi := q.(*qcow2)
+	r := qi.refcounts()
+	r.set(qi.header.l1Offset()/int64(qi.header.clusterSize()), 0)
+	r.flush()
+
+	q2, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := q2.Recovery()
+	if res == nil || res.LeaksFixed != 1 || res.Corruptions == 0 {
+		t.Fatalf("%+v", res)
+	}
+	if !q2.(*qcow2).header.dirty() {
+		t.Fatal("Marked clean despite corruption")
+	}
+}
+
+func TestOpenDirtyRepairAll(t *testing.T) {
+	f := tempFile(t)
+	q, err := Create(f, CreateOptions{Size: 4 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaveDirty(t, q)
+	qi := q.(*qcow2)
+	r := qi.refcounts()
+	r.set(qi.header.l1Offset()/int64(qi.header.clusterSize()), 0)
+	r.flush()
+
+	q2, err := OpenWithOptions(f, OpenOptions{Recover: RepairAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := q2.Recovery()
+	if res == nil || !res.Clean() || res.LeaksFixed != 1 || res.CorruptionsFixed == 0 {
+		t.Fatalf("%+v", res)
+	}
+	if q2.(*qcow2).header.dirty() {
+		t.Fatal("Still dirty after repair")
+	}
+}
+
+func TestDirtyBit(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		f := tempFile(t)
+		q, err := Create(f, CreateOptions{Size: 4 << 20, Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := q.(*qcow2).header
+		if h.dirty() {
+			t.Fatal("New file is dirty")
+		}
+
+		// Only version 3 has a dirty bit, and only writing sets it
+		g, err := q.Guest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.ReadAt(make([]byte, 100), 0); err != nil {
+			t.Fatal(err)
+		}
+		if h.dirty() {
+			t.Fatal("Reading made the file dirty")
+		}
+		if _, err := g.WriteAt([]byte{1}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if h.dirty() != (version == 3) {
+			t.Fatalf("Version %d dirty: %t", version, h.dirty())
+		}
+
+		// Closing the guest isn't enough, the file must be closed
+		if err := g.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if h.dirty() != (version == 3) {
+			t.Fatal("Closing the guest marked the file clean")
+		}
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+		q, err = Open(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.(*qcow2).header.dirty() || q.Recovery() != nil {
+			t.Fatal("Closed file is still dirty")
+		}
+	}
+}
+
+// A file that counts how often it's synced
+type syncCounter struct {
+	*os.File
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return s.File.Sync()
+}
+
+func TestFlush(t *testing.T) {
+	f := &syncCounter{File: tempFile(t)}
+	q, err := Create(f, CreateOptions{Size: 4 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := q.GuestWithOptions(GuestOptions{CacheSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("flushed")
+	if _, err := g.WriteAt(data, 3<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a flush, another reader of the file sees the data
+	syncs := f.syncs
+	if err := g.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if f.syncs == syncs {
+		t.Fatal("Flush didn't sync")
+	}
+	q2, err := OpenReadOnly(f.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := q2.Guest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := g2.ReadAt(got, 3<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Flushed data isn't in the file")
+	}
+
+	// Closing syncs too, even with a guest still open
+	syncs = f.syncs
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.syncs == syncs || q.(*qcow2).header.dirty() {
+		t.Fatal("Close didn't sync and mark the file clean")
+	}
+}
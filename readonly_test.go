@@ -0,0 +1,126 @@
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+// A file that records any attempt to change it
+type changeRecorder struct {
+	*os.File
+	changes int
+}
+
+var errChanged = errors.New("Tried to change a read-only file")
+
+func (c *changeRecorder) WriteAt(p []byte, off int64) (int, error) {
+	c.changes++
+	return 0, errChanged
+}
+
+func (c *changeRecorder) Truncate(size int64) error {
+	c.changes++
+	return errChanged
+}
+
+func (c *changeRecorder) Sync() error {
+	c.changes++
+	return errChanged
+}
+
+// Make a dirty file, with an unknown autoclear feature. Opening it for
+// writing would change the header.
+func readOnlyImage(tb testing.TB) (*os.File, []byte) {
+	f := tempFile(tb)
+	q, err := Create(f, CreateOptions{Size: 4 << 20, ClusterBits: 12})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	data := fillGuest(tb, q, 1<<20, 1)
+	leaveDirty(tb, q)
+	copy(data, make([]byte, 1<<20))
+	data[0] = 1
+	q.(*qcow2).header.io().WriteUint64(88, 1<<40)
+	return f, data
+}
+
+func TestReadOnly(t *testing.T) {
+	f, data := readOnlyImage(t)
+	rec := &changeRecorder{File: f}
+	q, err := OpenReadOnly(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Recovery() != nil {
+		t.Fatal("Recovered a read-only file")
+	}
+	g, err := q.Guest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := g.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data doesn't match")
+	}
+
+	// Changes fail with a typed error
+	isReadOnly := func(err error) {
+		t.Helper()
+		if _, ok := err.(*ReadOnlyError); !ok {
+			t.Fatalf("Expected a read-only error, got %v", err)
+		}
+	}
+	_, err = g.WriteAt([]byte{1}, 0)
+	isReadOnly(err)
+	isReadOnly(g.Discard(0, 4096))
+	isReadOnly(g.WriteZeroes(0, 4096, false))
+	_, err = q.Check(RepairLeaks)
+	isReadOnly(err)
+
+	// Checking works, and sees the leak
+	res, err := q.Check(CheckOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Leaks != 1 {
+		t.Fatalf("%+v", res)
+	}
+	if err := g.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	isReadOnly(q.Compact(nil))
+	_, err = q.Defrag(nil)
+	isReadOnly(err)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rec.changes != 0 {
+		t.Fatalf("Tried to change the file %d times", rec.changes)
+	}
+}
+
+func TestReadOnlyReader(t *testing.T) {
+	// Any io.ReaderAt works, not just files
+	f, data := readOnlyImage(t)
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, fi.Size())
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	q, err := OpenReadOnly(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyGuest(t, q, data)
+}
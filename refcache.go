@@ -0,0 +1,114 @@
+package qcow2
+
+import (
+	"sync"
+
+	"github.com/vasi/qcow2/eio"
+)
+
+// How many bytes of refcount blocks to cache
+const refcountCacheSize = 256 * 1024
+
+// A cache of the refcount table and recently used refcount blocks.
+//
+// Table changes go straight through to the file. Block changes are held until
+// the block is evicted, or the cache is flushed.
+type refcountCache struct {
+	header header
+	blocks *metadataCache
+
+	// The refcount table, and where it was loaded from
+	table       []uint64
+	tableOffset int64
+
+	sync.Mutex
+}
+
+func newRefcountCache(h header) *refcountCache {
+	size := int64(refcountCacheSize)
+	if min := int64(4 * h.clusterSize()); size < min {
+		size = min
+	}
+	return &refcountCache{
+		header: h,
+		blocks: newMetadataCache(h.io(), h.clusterSize(), size),
+	}
+}
+
+func (c *refcountCache) io() *eio.BinaryIO {
+	return c.header.io()
+}
+
+// Get the refcount table, reloading it if it moved. Must hold the lock.
+func (c *refcountCache) loadTable() []uint64 {
+	off, clusters := c.header.refcountTable()
+	size := clusters * c.header.clusterSize()
+	if c.table != nil && c.tableOffset == off && len(c.table)*8 == size {
+		return c.table
+	}
+
+	buf := make([]byte, size)
+	c.io().ReadAt(off, buf)
+	c.table = make([]uint64, size/8)
+	for i := range c.table {
+		c.table[i] = c.io().ByteOrder().Uint64(buf[i*8:])
+	}
+	c.tableOffset = off
+	return c.table
+}
+
+// Read a raw table entry, given its offset in bytes within the table. Entries
+// past the end of the table are empty.
+func (c *refcountCache) tableEntry(tableOffset int64) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	table := c.loadTable()
+	if tableOffset/8 >= int64(len(table)) {
+		return 0
+	}
+	return table[tableOffset/8]
+}
+
+// Write a table entry, given its offset in bytes within the table
+func (c *refcountCache) setTableEntry(tableOffset int64, e uint64) {
+	c.Lock()
+	defer c.Unlock()
+	table := c.loadTable()
+	c.io().WriteUint64(c.tableOffset+tableOffset, e)
+	table[tableOffset/8] = e
+}
+
+// Read bytes from within a block
+func (c *refcountCache) read(block int64, pos int, buf []byte) {
+	c.blocks.readAt(block+int64(pos), buf)
+}
+
+// Write bytes within a block
+func (c *refcountCache) write(block int64, pos int, buf []byte) {
+	c.blocks.writeAt(block+int64(pos), buf)
+}
+
+// Read a whole block. If it's not cached, it's read without being cached.
+func (c *refcountCache) peek(block int64, buf []byte) {
+	c.blocks.peek(block, buf)
+}
+
+// Forget a block without writing it, because it's being replaced
+func (c *refcountCache) forget(block int64) {
+	c.blocks.forget(block)
+}
+
+// Write all dirty blocks to the file
+func (c *refcountCache) flush() {
+	c.blocks.flush()
+}
+
+// Write all dirty blocks, and forget everything, so the refcount structures
+// can be modified directly
+func (c *refcountCache) invalidate() {
+	c.blocks.invalidate()
+
+	c.Lock()
+	defer c.Unlock()
+	c.table = nil
+}
@@ -1,6 +1,8 @@
 package qcow2
 
 import (
+	"sync"
+
 	"github.com/timtadh/data-structures/exc"
 	"github.com/vasi/qcow2/eio"
 )
@@ -15,24 +17,46 @@ type refcount struct {
 type refcounts interface {
 	// Setup a new refcounts structure
 	open(header)
+	// Write back any cached changes, when done with the refcounts
 	close()
-
-	// Get the refcount of a block
+	// Write back any cached changes, and deallocate and release clusters
+	// that were freed before it
+	flush()
+	// Write back and forget cached refcounts and free clusters, so the
+	// structures can be modified directly
+	invalidate()
+	// The cache of refcount blocks, so other metadata can be ordered after it
+	blockCache() *metadataCache
+
+	// Get the refcount of a block. This may run concurrently with changes.
 	refcount(idx int64) uint64
 
 	// Increment a block's refcount. Must be already allocated!
 	increment(idx int64) uint64
-	// Decrement a block's refcount.
-	decrement(idx int64) uint64
+	// Decrement a block's refcount. If it becomes free, it's deallocated and
+	// may be allocated again according to the reuse policy, once the metadata
+	// that referenced it is written.
+	decrement(idx int64, reuse ReusePolicy) uint64
+
+	// Set a block's refcount directly. Returns false if there is no valid
+	// refcount block to hold it.
+	set(idx int64, rc uint64) bool
+
+	// Replace the refcount table and blocks with new ones, holding the given
+	// refcounts. The new structures are placed at or after cluster start,
+	// which must be past anything that must survive until the switch.
+	rebuild(counts []uint64, start int64)
 
 	// What's the maximum block index without growing the refcount table?
 	max() int64
 
-	// Allocate n new blocks, return the index of the first block
-	allocate(n int64) int64
+	// Allocate n new contiguous blocks, return the index of the first block
+	allocate(n int64, strategy AllocStrategy) int64
 
 	// Iterate over used blocks
 	used(*eio.Pipeline) <-chan refcount
+	// Read every refcount in the refcount block at a given file offset
+	readBlock(off int64) []uint64
 }
 
 // Mask for valid bits of a refcount table entry
@@ -42,23 +66,71 @@ const tableValid uint64 = ^uint64(0x1ff)
 type refcountsImpl struct {
 	// The qcow2 header.
 	header header
+	// Cached refcount table and blocks
+	cache *refcountCache
+
+	// Which clusters are in use, loaded when we first allocate
+	free *freeMap
+	// Clusters freed by decrement, which stay in use until the next flush
+	freed []freedCluster
+
+	// Serialize changes to refcounts, so concurrent allocations don't collide.
+	// Reads don't need it, the cache is safe for concurrent use.
+	sync.Mutex
+}
 
-	// A pipeline for free clusters
-	freeClustersPipeline *eio.Pipeline
-	// A channel that receives free clusters
-	freeClusters <-chan int64
+// A cluster waiting for a flush before it's deallocated and released
+type freedCluster struct {
+	idx   int64
+	reuse ReusePolicy
 }
 
 func (r *refcountsImpl) open(header header) {
 	r.header = header
-
-	// Setup free cluster finding
-	r.freeClustersPipeline = eio.NewPipeline()
-	r.freeClusters = r.findFreeClusters(r.freeClustersPipeline)
+	r.cache = newRefcountCache(header)
 }
 
 func (r *refcountsImpl) close() {
-	r.freeClustersPipeline.WaitThrow()
+	r.flush()
+}
+
+func (r *refcountsImpl) flush() {
+	r.Lock()
+	defer r.Unlock()
+	r.writeBack()
+}
+
+// Write back cached refcounts, then deallocate and release the clusters that
+// were freed. Must hold the lock.
+func (r *refcountsImpl) writeBack() {
+	// Flushing refcounts writes the mapping tables they depend on first
+	r.cache.flush()
+
+	cs := int64(r.clusterSize())
+	for _, f := range r.freed {
+		r.io().PunchHole(f.idx*cs, cs)
+		if r.free != nil {
+			r.free.release(f.idx, f.reuse)
+		}
+	}
+	r.freed = nil
+}
+
+func (r *refcountsImpl) invalidate() {
+	r.Lock()
+	defer r.Unlock()
+	r.reset()
+}
+
+// Forget cached refcounts and free clusters. Must hold the lock.
+func (r *refcountsImpl) reset() {
+	r.writeBack()
+	r.cache.invalidate()
+	r.free = nil
+}
+
+func (r *refcountsImpl) blockCache() *metadataCache {
+	return r.cache.blocks
 }
 
 // Get our IO
@@ -92,17 +164,17 @@ func (r *refcountsImpl) max() int64 {
 }
 
 // Get some useful info for refcount reading and writing.
-func (r *refcountsImpl) ioInfo(block int64, count int) (offBits int, fileOff int64, buf []byte) {
+func (r *refcountsImpl) ioInfo(count int) (offBits int, pos int, buf []byte) {
 	offBits = int(r.bits()) * count
-	fileOff = block + int64(offBits/8)
-	bufSize := divceil(int64(r.bits()), 8)
+	pos = offBits / 8
+	bufSize := eio.DivCeil(int64(r.bits()), 8)
 	buf = make([]byte, bufSize)
 	return
 }
 
 // Read a refcount in a buffer, by count
 func (r *refcountsImpl) readBuf(buf []byte, bits int) (rc uint64) {
-	nbytes := divceil(int64(r.bits()), 8)
+	nbytes := eio.DivCeil(int64(r.bits()), 8)
 	rc = 0
 	for i := 0; i < int(nbytes); i++ {
 		rc <<= 8
@@ -114,12 +186,30 @@ func (r *refcountsImpl) readBuf(buf []byte, bits int) (rc uint64) {
 	return rc
 }
 
+// Write a refcount into a buffer, by count
+func (r *refcountsImpl) writeBuf(buf []byte, bits int, rc uint64) {
+	if r.bits() < 8 {
+		shift := uint(bits % 8)
+		mask := byte((1 << r.bits()) - 1)
+		// Mask out the old value
+		buf[0] &^= mask << shift
+		// Or in the new value
+		buf[0] |= (byte(rc) & mask) << shift
+	} else {
+		nbytes := int(r.bits() / 8)
+		for i := 0; i < nbytes; i++ {
+			buf[nbytes-i-1] = byte(rc & 0xff)
+			rc >>= 8
+		}
+	}
+}
+
 // Read a single refcount.
 // 	block - The file offset of the refcount block to read from
 //  count - The index of the refcount within that block
 func (r *refcountsImpl) read(block int64, count int) uint64 {
-	offBits, fileOff, buf := r.ioInfo(block, count)
-	r.io().ReadAt(fileOff, buf)
+	offBits, pos, buf := r.ioInfo(count)
+	r.cache.read(block, pos, buf)
 	return r.readBuf(buf, offBits)
 }
 
@@ -127,26 +217,13 @@ func (r *refcountsImpl) read(block int64, count int) uint64 {
 // 	block - The file offset of the refcount block to write to
 //  count - The index of the refcount within that block
 func (r *refcountsImpl) write(block int64, count int, rc uint64) {
-	offBits, fileOff, buf := r.ioInfo(block, count)
-
+	offBits, pos, buf := r.ioInfo(count)
 	if r.bits() < 8 {
 		// Fetch the existing content of this byte
-		r.io().ReadAt(fileOff, buf)
-
-		shift := uint(offBits % 8)
-		mask := byte((1 << r.bits()) - 1)
-		// Mask out the old value
-		buf[0] &^= mask << shift
-		// Or in the new value
-		buf[0] |= (byte(rc) & mask) << shift
-	} else {
-		for i := 0; i < len(buf); i++ {
-			buf[len(buf)-i-1] = byte(rc & 0xff)
-			rc >>= 8
-		}
+		r.cache.read(block, pos, buf)
 	}
-
-	r.io().WriteAt(fileOff, buf)
+	r.writeBuf(buf, offBits, rc)
+	r.cache.write(block, pos, buf)
 }
 
 // Validate a table entry
@@ -162,8 +239,7 @@ func (r *refcountsImpl) validateTableEntry(tableEntry uint64) int64 {
 
 // Read a single table entry, given an offset (in bytes) within the table
 func (r *refcountsImpl) readTableEntry(tableOffset int64) int64 {
-	entry := r.io().ReadUint64(r.header.refcountOffset() + tableOffset)
-	return r.validateTableEntry(entry)
+	return r.validateTableEntry(r.cache.tableEntry(tableOffset))
 }
 
 // An operation on refcounts
@@ -175,7 +251,7 @@ type rcOp func(rc uint64, missing bool) uint64
 // Perform an operation on a refcount
 func (r *refcountsImpl) refcountOp(idx int64, op rcOp) uint64 {
 	tableOffset := r.tableOffset(idx)
-	if tableOffset > int64(r.clusterSize()*r.header.refcountClusters()) {
+	if tableOffset >= int64(r.clusterSize()*r.header.refcountClusters()) {
 		return op(0, true)
 	}
 
@@ -207,6 +283,8 @@ func (r *refcountsImpl) refcount(idx int64) uint64 {
 }
 
 func (r *refcountsImpl) increment(idx int64) uint64 {
+	r.Lock()
+	defer r.Unlock()
 	return r.refcountOp(idx, func(rc uint64, missing bool) uint64 {
 		if missing || rc == 0 {
 			exc.Throwf("Modifying unallocated refcount")
@@ -218,60 +296,87 @@ func (r *refcountsImpl) increment(idx int64) uint64 {
 	})
 }
 
-func (r *refcountsImpl) decrement(idx int64) uint64 {
-	return r.refcountOp(idx, func(rc uint64, missing bool) uint64 {
+func (r *refcountsImpl) decrement(idx int64, reuse ReusePolicy) uint64 {
+	r.Lock()
+	defer r.Unlock()
+
+	// Until a flush, a crash could leave old metadata pointing at the cluster,
+	// so keep its data and don't reuse it yet
+	rc := r.deref(idx, ReuseNever)
+	if rc == 0 {
+		r.freed = append(r.freed, freedCluster{idx, reuse})
+		if reuse == ReuseImmediately {
+			r.writeBack()
+		}
+	}
+	return rc
+}
+
+// Decrement a refcount. Must hold the lock.
+func (r *refcountsImpl) deref(idx int64, reuse ReusePolicy) uint64 {
+	rc := r.refcountOp(idx, func(rc uint64, missing bool) uint64 {
 		if missing || rc == 0 {
 			exc.Throwf("Modifying unallocated refcount")
 		}
 		return rc - 1
 	})
+	if rc == 0 && r.free != nil {
+		r.free.release(idx, reuse)
+	}
+	return rc
 }
 
-// Look for free clusters, and write them to a channel
-func (r *refcountsImpl) findFreeClusters(pipe *eio.Pipeline) <-chan int64 {
-	ch := make(chan int64)
-	pipe.Go(func() {
-		defer close(ch)
+func (r *refcountsImpl) set(idx int64, rc uint64) bool {
+	r.Lock()
+	defer r.Unlock()
 
-		// Quickly find a place to start
-		var rc refcount
-		for rc = range r.fastScan(pipe, false) {
-			if rc.rc == 0 {
-				break
-			}
-		}
+	tableOffset := r.tableOffset(idx)
+	if tableOffset >= int64(r.clusterSize()*r.header.refcountClusters()) {
+		return false
+	}
 
-		for i := rc.idx; true; i++ {
-			if r.refcount(i) == 0 {
-				select {
-				case <-pipe.Done():
-					return
-				case ch <- i:
-				}
-			}
+	// Don't throw on bad entries, the caller may be repairing them
+	tableEntry := r.cache.tableEntry(tableOffset)
+	if tableEntry == 0 || tableEntry&^tableValid != 0 || tableEntry%uint64(r.clusterSize()) != 0 {
+		return false
+	}
+	r.write(int64(tableEntry), int(idx%r.blockEntries()), rc)
+	if r.free != nil {
+		if rc == 0 {
+			r.free.free(idx)
+		} else {
+			r.free.use(idx, 1)
 		}
-	})
-	return ch
+	}
+	return true
 }
 
-// Find a sequence of n free clusters.
-func (r *refcountsImpl) findFreeSequence(n int64) int64 {
-	var count, start int64
-	for b := range r.freeClusters {
-		if count > 0 || start+count == b {
-			// Continue a range
-			count++
-		} else {
-			count = 1
-			start = b
-		}
+// Get the map of used clusters, scanning the refcount blocks if it's not
+// loaded yet. Must hold the lock.
+func (r *refcountsImpl) freeMap() *freeMap {
+	if r.free != nil {
+		return r.free
+	}
 
-		if count == n {
-			return start
+	m := &freeMap{}
+	pipe := eio.NewPipeline()
+	for rc := range r.used(pipe) {
+		if rc.rc != 0 {
+			m.use(rc.idx, 1)
 		}
 	}
-	r.freeClustersPipeline.WaitThrow()
-	return 0 // Must have been an error, will throw above
+	pipe.WaitThrow()
+	// Freed clusters may not be free on disk yet, and must not be reused
+	for _, f := range r.freed {
+		m.use(f.idx, 1)
+	}
+	r.free = m
+	return m
+}
+
+// Find a sequence of n free clusters, and reserve them. Must hold the lock.
+func (r *refcountsImpl) findFreeSequence(n int64, strategy AllocStrategy) int64 {
+	return r.freeMap().allocate(n, strategy)
 }
 
 // Create the initial reference for a new cluster
@@ -283,7 +388,8 @@ func (r *refcountsImpl) refNewCluster(idx int64) {
 
 // Grow the top-level refcount table.
 func (r *refcountsImpl) growTable() {
-	newTableStart := r.findFreeSequence(1)
+	// The table and its new blocks go at the end, where there's always room
+	newTableStart := r.freeMap().find(1, AllocAppend)
 
 	// Find an appropriate table size
 	var newBlocks int64
@@ -305,10 +411,7 @@ func (r *refcountsImpl) growTable() {
 	}
 
 	// Create and fill the new table
-	next := r.findFreeSequence(tableSize - 1 + newBlocks)
-	if next != newTableStart+1 {
-		exc.Throwf("Couldn't allocate refcount table???")
-	}
+	r.freeMap().use(newTableStart, tableSize+newBlocks)
 	cs := r.clusterSize()
 	r.io().Copy(newTableStart*int64(cs), r.header.refcountOffset(),
 		r.header.refcountClusters()*cs)
@@ -321,6 +424,7 @@ func (r *refcountsImpl) growTable() {
 	newTablePos := newTableStart * int64(cs)
 	for b := 0; int64(b) < newBlocks; b++ {
 		blockPos := (blockBase + int64(b)) * int64(cs)
+		r.cache.forget(blockPos)
 		r.io().Zero(blockPos, cs)
 		r.io().WriteUint64(newTablePos+blockOff, uint64(blockPos))
 		blockOff += 8
@@ -334,17 +438,99 @@ func (r *refcountsImpl) growTable() {
 		newClusterOffset++
 	}
 
-	// Set the header values
+	// Set the header values, once the new structures are on disk
+	r.writeBack()
 	oldSize := r.header.refcountClusters()
 	oldIdx := r.header.refcountOffset() / int64(r.clusterSize())
 	r.header.setRefcountTable(newTableStart*int64(cs), int(tableSize))
 
 	// Deref the old table
 	for i := 0; i < oldSize; i++ {
-		r.decrement(oldIdx + int64(i))
+		r.deref(oldIdx+int64(i), ReuseImmediately)
 	}
 }
 
+func (r *refcountsImpl) readBlock(off int64) []uint64 {
+	block := make([]byte, r.clusterSize())
+	r.cache.peek(off, block)
+
+	counts := make([]uint64, r.blockEntries())
+	for i := range counts {
+		bits := i * int(r.bits())
+		counts[i] = r.readBuf(block[bits/8:], bits)
+	}
+	return counts
+}
+
+func (r *refcountsImpl) rebuild(counts []uint64, start int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	// The old structures are going away, don't let cached blocks outlive them
+	r.reset()
+
+	// Start with an empty table, big enough to describe itself. Until we
+	// switch to it, only the new structures know where it is.
+	cs := int64(r.clusterSize())
+	if start < int64(len(counts)) {
+		start = int64(len(counts))
+	}
+	tableSize := int64(1)
+	for tableSize*cs/8*r.blockEntries() < start+tableSize {
+		tableSize++
+	}
+	r.io().Zero(start*cs, int(tableSize*cs))
+	h := &detachedHeader{header: r.header, tableOffset: start * cs, tableClusters: int(tableSize)}
+	nr := &refcountsImpl{}
+	nr.open(h)
+
+	// Never allocate before the start, even in free clusters, since the old
+	// structures may still be there
+	nr.free = &freeMap{}
+	nr.free.use(0, start+tableSize)
+
+	// Set every refcount, letting the usual logic allocate blocks and grow the
+	// table at the end of the file
+	for i := start; i < start+tableSize; i++ {
+		nr.refNewCluster(i)
+	}
+	for idx, rc := range counts {
+		if rc == 0 {
+			continue
+		}
+		blockOff := nr.allocRefcountBlock(int64(idx))
+		nr.write(blockOff, int(int64(idx)%nr.blockEntries()), rc)
+	}
+
+	// Switch to the new structures, once they're on disk
+	nr.writeBack()
+	r.header.setRefcountTable(h.refcountTable())
+}
+
+// A header whose refcount table can be moved without changing the file, so
+// new refcount structures can be built before switching to them
+type detachedHeader struct {
+	header
+	tableOffset   int64
+	tableClusters int
+}
+
+func (h *detachedHeader) refcountOffset() int64 {
+	return h.tableOffset
+}
+
+func (h *detachedHeader) refcountClusters() int {
+	return h.tableClusters
+}
+
+func (h *detachedHeader) refcountTable() (offset int64, clusters int) {
+	return h.tableOffset, h.tableClusters
+}
+
+func (h *detachedHeader) setRefcountTable(offset int64, clusters int) {
+	h.tableOffset, h.tableClusters = offset, clusters
+}
+
 // Allocate a single refcount block to reference cluster idx. Return the position of the block.
 func (r *refcountsImpl) allocRefcountBlock(idx int64) int64 {
 	tableOffset := r.tableOffset(idx)
@@ -357,9 +543,10 @@ func (r *refcountsImpl) allocRefcountBlock(idx int64) int64 {
 	}
 
 	// Didn't find a refcount block, must allocate one
-	blockIdx := r.findFreeSequence(1)
+	blockIdx := r.findFreeSequence(1, AllocFirstFit)
 	// Zero the new block
 	blockOff := blockIdx * int64(r.clusterSize())
+	r.cache.forget(blockOff)
 	r.io().Zero(blockOff, r.clusterSize())
 
 	// Check if the refcount for this block is inside itself
@@ -373,13 +560,17 @@ func (r *refcountsImpl) allocRefcountBlock(idx int64) int64 {
 		r.refNewCluster(blockIdx)
 	}
 
-	// Write the new entry in the table
-	r.io().WriteUint64(tableOffset+r.header.refcountOffset(), uint64(blockOff))
+	// Write the new entry in the table, once the block is on disk
+	r.writeBack()
+	r.cache.setTableEntry(tableOffset, uint64(blockOff))
 	return blockOff
 }
 
-func (r *refcountsImpl) allocate(n int64) int64 {
-	idx := r.findFreeSequence(n)
+func (r *refcountsImpl) allocate(n int64, strategy AllocStrategy) int64 {
+	r.Lock()
+	defer r.Unlock()
+
+	idx := r.findFreeSequence(n, strategy)
 	for i := idx; i < idx+n; i++ {
 		r.refNewCluster(i)
 	}
@@ -391,20 +582,16 @@ func (r *refcountsImpl) fastScan(pipe *eio.Pipeline, onlyUsed bool) <-chan refco
 	pipe.Go(func() {
 		defer close(ch)
 
-		// Cache table and blocks, to quickly get new items
-		// Maybe take this out if we add a caching layer?
-		table := make([]byte, r.clusterSize()*r.header.refcountClusters())
-		r.io().ReadAt(r.header.refcountOffset(), table)
-
+		// Read whole blocks, without pushing useful ones out of the cache
 		block := make([]byte, r.clusterSize())
-		for ti := 0; ti < len(table)/8; ti++ {
-			rawEntry := r.io().ByteOrder().Uint64(table[8*ti:])
-			tableEntry := r.validateTableEntry(rawEntry)
+		entries := r.clusterSize() * r.header.refcountClusters() / 8
+		for ti := 0; ti < entries; ti++ {
+			tableEntry := r.readTableEntry(int64(8 * ti))
 			if tableEntry == 0 && onlyUsed {
 				continue
 			}
-			if tableEntry != 0 { // Read the table
-				r.io().ReadAt(tableEntry, block)
+			if tableEntry != 0 { // Read the block
+				r.cache.peek(tableEntry, block)
 			}
 
 			var rc uint64
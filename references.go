@@ -0,0 +1,203 @@
+package qcow2
+
+// The kind of structure a reference points to
+type refKind int
+
+const (
+	refHeader refKind = iota
+	refL1Table
+	refL2Table
+	refData
+	refCompressed
+	refRefcountTable
+	refRefcountBlock
+	refSnapshotTable
+	refBitmapDirectory
+	refBitmapTable
+	refBitmapData
+)
+
+var refKindNames = map[refKind]string{
+	refHeader:          "header",
+	refL1Table:         "L1 table",
+	refL2Table:         "L2 table",
+	refData:            "data cluster",
+	refCompressed:      "compressed cluster",
+	refRefcountTable:   "refcount table",
+	refRefcountBlock:   "refcount block",
+	refSnapshotTable:   "snapshot table",
+	refBitmapDirectory: "bitmap directory",
+	refBitmapTable:     "bitmap table",
+	refBitmapData:      "bitmap data",
+}
+
+func (k refKind) String() string {
+	return refKindNames[k]
+}
+
+// A reference from one qcow2 structure to a range of the file
+type reference struct {
+	kind refKind
+	// The position in the file of the entry holding this reference. Zero if
+	// the reference is held in the header.
+	from int64
+	// The raw entry, for references held in a table
+	entry uint64
+	// The range of the file that is referred to
+	offset int64
+	size   int64
+	// Whether this reference belongs to the active layer, rather than a snapshot
+	active bool
+}
+
+// The first and last cluster indices covered by a reference
+func (ref reference) clusters(clusterSize int) (first int64, last int64) {
+	cs := int64(clusterSize)
+	return ref.offset / cs, (ref.offset + ref.size - 1) / cs
+}
+
+// A function to call on each reference.
+//
+// It should return false if the walk should not descend into the structure
+// that is referenced, eg: if it is invalid.
+type refVisitor func(ref reference) bool
+
+// Walks all the structures in a qcow2 file
+type refWalker struct {
+	header header
+	visit  refVisitor
+}
+
+// Visit every reference to a range of the file
+func walkReferences(h header, visit refVisitor) {
+	w := &refWalker{h, visit}
+	cs := int64(h.clusterSize())
+
+	w.visit(reference{kind: refHeader, offset: 0, size: cs})
+
+	// Active layer
+	w.walkL1(0, h.l1Offset(), h.l1Entries(), true)
+
+	// Snapshots
+	if h.snapshotsOffset() != 0 {
+		snaps, size := readSnapshotTable(h)
+		if w.visit(reference{kind: refSnapshotTable, offset: h.snapshotsOffset(), size: size}) {
+			for _, s := range snaps {
+				w.walkL1(s.entryOffset, s.l1Position, s.l1Entries, false)
+			}
+		}
+	}
+
+	w.walkRefcounts()
+	w.walkBitmaps()
+}
+
+// Read a table of 64-bit entries
+func (w *refWalker) readTable(off int64, entries int) []uint64 {
+	buf := make([]byte, entries*8)
+	w.header.io().ReadAt(off, buf)
+	order := w.header.io().ByteOrder()
+	table := make([]uint64, entries)
+	for i := range table {
+		table[i] = order.Uint64(buf[i*8:])
+	}
+	return table
+}
+
+// Walk an L1 table and everything it refers to
+func (w *refWalker) walkL1(from int64, off int64, entries int, active bool) {
+	if entries == 0 {
+		return
+	}
+	if !w.visit(reference{kind: refL1Table, from: from, offset: off,
+		size: int64(entries) * 8, active: active}) {
+		return
+	}
+
+	cs := int64(w.header.clusterSize())
+	for i, e := range w.readTable(off, entries) {
+		l2 := int64(e & offsetMask)
+		if l2 == 0 {
+			continue
+		}
+		ref := reference{kind: refL2Table, from: off + int64(i)*8, entry: e,
+			offset: l2, size: cs, active: active}
+		if w.visit(ref) {
+			w.walkL2(l2, active)
+		}
+	}
+}
+
+// Walk an L2 table and the data it refers to
+func (w *refWalker) walkL2(off int64, active bool) {
+	cs := int64(w.header.clusterSize())
+	bits := w.header.clusterBits()
+	for i, e := range w.readTable(off, int(cs/8)) {
+		from := off + int64(i)*8
+		me := mapEntry(e)
+		if me.compressed() {
+			w.visit(reference{kind: refCompressed, from: from, entry: e,
+				offset: me.compressedOffset(bits), size: me.compressedSize(bits),
+				active: active})
+			continue
+		}
+
+		data := int64(e & offsetMask)
+		if data == 0 {
+			continue
+		}
+		w.visit(reference{kind: refData, from: from, entry: e, offset: data, size: cs,
+			active: active})
+	}
+}
+
+// Walk the refcount table and blocks
+func (w *refWalker) walkRefcounts() {
+	cs := int64(w.header.clusterSize())
+	off := w.header.refcountOffset()
+	clusters := w.header.refcountClusters()
+	if !w.visit(reference{kind: refRefcountTable, offset: off, size: int64(clusters) * cs}) {
+		return
+	}
+
+	for i, e := range w.readTable(off, clusters*int(cs/8)) {
+		block := int64(e & tableValid)
+		if block == 0 {
+			continue
+		}
+		w.visit(reference{kind: refRefcountBlock, from: off + int64(i)*8, entry: e,
+			offset: block, size: cs})
+	}
+}
+
+// Walk the bitmap directory and bitmaps
+func (w *refWalker) walkBitmaps() {
+	ext, ok := readBitmapsExtension(w.header)
+	if !ok || ext.NbBitmaps == 0 {
+		return
+	}
+
+	cs := int64(w.header.clusterSize())
+	if !w.visit(reference{kind: refBitmapDirectory, offset: int64(ext.BitmapDirectoryOffset),
+		size: int64(ext.BitmapDirectorySize)}) {
+		return
+	}
+
+	for _, b := range readBitmaps(w.header, ext) {
+		if b.tableSize == 0 {
+			continue
+		}
+		if !w.visit(reference{kind: refBitmapTable, from: b.entryOffset,
+			offset: b.tableOffset, size: int64(b.tableSize) * 8}) {
+			continue
+		}
+		for i, e := range w.readTable(b.tableOffset, b.tableSize) {
+			data := int64(e & offsetMask)
+			if data == 0 {
+				continue
+			}
+			w.visit(reference{kind: refBitmapData, from: b.tableOffset + int64(i)*8,
+				entry: e, offset: data, size: cs})
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package qcow2
+
+import "github.com/vasi/qcow2/eio"
+
+// RepairMode describes which problems Check should fix
+type RepairMode int
+
+const (
+	// CheckOnly just reports problems, without modifying the file
+	CheckOnly RepairMode = 0
+	// RepairLeaks fixes refcounts that are too high
+	RepairLeaks RepairMode = 1
+	// RepairErrors fixes refcounts that are too low, bad COPIED flags and
+	// invalid entries. Invalid entries are dropped, so their data is lost.
+	RepairErrors RepairMode = 2
+	// RepairAll fixes everything that can be fixed
+	RepairAll = RepairLeaks | RepairErrors
+)
+
+// Check a file, and repair it according to the given mode
+func (c *checker) repair(mode RepairMode) *CheckResult {
+	before := c.check()
+	if mode == CheckOnly || before.Clean() {
+		return before
+	}
+
+	rebuild := false
+	if mode&RepairErrors != 0 {
+		if c.dropBroken() {
+			rebuild = true
+		}
+		c.check()
+	}
+
+	if !rebuild {
+		rebuild = !c.fixRefcounts(mode)
+	}
+	if rebuild && mode&RepairErrors != 0 {
+		c.rebuildRefcounts()
+	}
+
+	if mode&RepairErrors != 0 {
+		c.check()
+		c.fixCopied()
+	}
+
+	after := c.check()
+	if before.Leaks > after.Leaks {
+		after.LeaksFixed = before.Leaks - after.Leaks
+	}
+	if before.Corruptions > after.Corruptions {
+		after.CorruptionsFixed = before.Corruptions - after.Corruptions
+	}
+	return after
+}
+
+// Drop invalid entries from the mapping tables.
+//
+// Returns true if the refcount structures themselves are invalid.
+func (c *checker) dropBroken() bool {
+	refcountsBroken := false
+	for _, ref := range c.broken {
+		switch ref.kind {
+		case refL2Table, refData, refCompressed:
+			c.header.io().WriteUint64(ref.from, 0)
+		case refRefcountTable, refRefcountBlock:
+			refcountsBroken = true
+		}
+	}
+	return refcountsBroken
+}
+
+// Fix refcounts in place.
+//
+// Returns false if some refcounts couldn't be fixed, because their refcount
+// block is missing or invalid.
+func (c *checker) fixRefcounts(mode RepairMode) bool {
+	max := int64(len(c.expected))
+	if int64(len(c.actual)) > max {
+		max = int64(len(c.actual))
+	}
+
+	// Refcounts in invalid blocks can't be fixed in place
+	brokenBlocks := make(map[int64]bool)
+	for _, ref := range c.broken {
+		switch ref.kind {
+		case refRefcountTable:
+			return false
+		case refRefcountBlock:
+			brokenBlocks[(ref.from-c.header.refcountOffset())/8] = true
+		}
+	}
+	blockEntries := c.clusterSize() * 8 / int64(c.header.refcountBits())
+
+	ok := true
+	for i := int64(0); i < max; i++ {
+		expected, actual := countAt(c.expected, i), countAt(c.actual, i)
+		if expected == actual {
+			continue
+		}
+		if actual > expected && mode&RepairLeaks == 0 {
+			continue
+		}
+		if actual < expected && mode&RepairErrors == 0 {
+			continue
+		}
+		if brokenBlocks[i/blockEntries] || !c.refcounts.set(i, expected) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Rebuild the refcount structures from scratch
+func (c *checker) rebuildRefcounts() {
+	counts := make([]uint64, len(c.expected))
+	copy(counts, c.expected)
+
+	// The old refcount structures will no longer be used
+	for _, ref := range c.refcountStructures {
+		first, last := ref.clusters(c.header.clusterSize())
+		for i := first; i <= last; i++ {
+			counts[i]--
+		}
+	}
+
+	end := len(counts)
+	for end > 0 && counts[end-1] == 0 {
+		end--
+	}
+	c.refcounts.rebuild(counts[:end], c.structuresEnd())
+}
+
+// Find the first cluster past everything in the file, including refcount
+// structures that may be referenced nowhere else
+func (c *checker) structuresEnd() int64 {
+	cs := c.clusterSize()
+	end := int64(len(c.expected))
+	if tableEnd := eio.DivCeil(c.header.refcountOffset(), cs) + int64(c.header.refcountClusters()); tableEnd > end {
+		end = tableEnd
+	}
+	if c.fileSize >= 0 && eio.DivCeil(c.fileSize, cs) > end {
+		end = eio.DivCeil(c.fileSize, cs)
+	}
+	return end
+}
+
+// Fix any incorrect COPIED flags
+func (c *checker) fixCopied() {
+	for _, ref := range c.copied {
+		entry := ref.entry &^ noCow
+		if c.wantCopied(ref) {
+			entry |= noCow
+		}
+		if entry != ref.entry {
+			c.header.io().WriteUint64(ref.from, entry)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package qcow2
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Fill a new guest with random data, returning what was written
+func fillGuest(tb testing.TB, q Qcow2, size int64, seed int64) []byte {
+	g, err := q.Guest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	if _, err := g.WriteAt(data, 0); err != nil {
+		tb.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// Check that the guest holds the expected data
+func verifyGuest(tb testing.TB, q Qcow2, data []byte) {
+	g, err := q.Guest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer g.Close()
+	p := make([]byte, len(data))
+	if _, err := g.ReadAt(p, 0); err != nil {
+		tb.Fatal(err)
+	}
+	if !bytes.Equal(p, data) {
+		tb.Fatal("Guest data changed")
+	}
+}
+
+// Check a file, and fail unless it's clean
+func requireClean(tb testing.TB, q Qcow2) {
+	res, err := q.Check(CheckOnly)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !res.Clean() {
+		tb.Fatal(res.Problems)
+	}
+}
+
+func TestRepairRebuildTableAtEnd(t *testing.T) {
+	// With small clusters and wide refcounts, the refcount table grows soon.
+	// Stop writing once it does, so the new table is at the end of the file.
+	q := tempImage(t, CreateOptions{Size: 8 << 20, ClusterBits: 9, RefcountBits: 64})
+	h := q.(*qcow2).header
+	cs := int64(h.clusterSize())
+	oldTable := h.refcountOffset()
+	g, err := q.Guest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 0, h.size())
+	rnd := rand.New(rand.NewSource(1))
+	for h.refcountOffset() == oldTable {
+		p := make([]byte, cs)
+		rnd.Read(p)
+		if _, err := g.WriteAt(p, int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, p...)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	table := h.refcountOffset()
+	size, _ := h.io().Size()
+	if table+int64(h.refcountClusters())*cs+cs < size {
+		t.Fatal("Refcount structures aren't at the end of the file")
+	}
+
+	// Break a refcount table entry, so the refcounts must be rebuilt
+	h.io().WriteUint64(table, 12345)
+	old := make([]byte, size-table)
+	h.io().ReadAt(table, old)
+
+	res, err := q.Check(RepairAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() || res.CorruptionsFixed == 0 {
+		t.Fatalf("%+v", res)
+	}
+	if h.refcountOffset() < size {
+		t.Fatal("New refcount table overlaps the old structures")
+	}
+	after := make([]byte, len(old))
+	h.io().ReadAt(table, after)
+	if !bytes.Equal(old, after) {
+		t.Fatal("Old refcount structures were overwritten before the switch")
+	}
+	requireClean(t, q)
+	verifyGuest(t, q, data)
+}
+
+func TestRepairBadRefcountBlock(t *testing.T) {
+	for _, entry := range []uint64{12345, 1 << 40} {
+		// Each refcount block covers 8 MB, so this uses two of them
+		q := tempImage(t, CreateOptions{Size: 16 << 20, ClusterBits: 12, RefcountBits: 16})
+		data := fillGuest(t, q, 12<<20, 2)
+		h := q.(*qcow2).header
+		size, _ := h.io().Size()
+
+		// Leak a cluster in the first block, and break the second one
+		r := q.(*qcow2).refcounts()
+		r.set(1, r.refcount(1)+1)
+		r.close()
+		h.io().WriteUint64(h.refcountOffset()+8, entry)
+
+		// The leak is fixed, and the bad block is still reported
+		res, err := q.Check(RepairLeaks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.LeaksFixed != 1 || res.Clean() {
+			t.Fatalf("%#x: %+v", entry, res)
+		}
+		if after, _ := h.io().Size(); after != size {
+			t.Fatal("Repairing leaks wrote outside the file")
+		}
+
+		res, err = q.Check(RepairAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Clean() {
+			t.Fatal(res.Problems)
+		}
+		requireClean(t, q)
+		verifyGuest(t, q, data)
+	}
+}
+
+func TestRepairModes(t *testing.T) {
+	q, data, _, l2Entry := checkImage(t)
+	h := q.(*qcow2).header
+	cluster := int64(h.io().ReadUint64(l2Entry)&offsetMask) / int64(h.clusterSize())
+
+	// Leak the header, and lose a reference to data
+	r := q.(*qcow2).refcounts()
+	r.set(0, 2)
+	r.set(cluster, 0)
+	r.close()
+
+	// Only the leak is fixed
+	res, err := q.Check(RepairLeaks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.LeaksFixed != 1 || res.CorruptionsFixed != 0 || res.Leaks != 0 || res.Corruptions == 0 {
+		t.Fatalf("%+v", res)
+	}
+
+	res, err = q.Check(RepairErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() || res.CorruptionsFixed == 0 {
+		t.Fatalf("%+v", res)
+	}
+	requireClean(t, q)
+	verifyGuest(t, q, data)
+}
+
+func TestRepairCopied(t *testing.T) {
+	q, data, l1Entry, _ := checkImage(t)
+	h := q.(*qcow2).header
+	h.io().WriteUint64(l1Entry, h.io().ReadUint64(l1Entry)&^noCow)
+
+	res, err := q.Check(RepairAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() || res.CorruptionsFixed != 1 {
+		t.Fatalf("%+v", res)
+	}
+	if h.io().ReadUint64(l1Entry)&noCow == 0 {
+		t.Fatal("COPIED flag wasn't restored")
+	}
+	verifyGuest(t, q, data)
+}
+
+func TestRepairDropsInvalid(t *testing.T) {
+	q, data, _, l2Entry := checkImage(t)
+	h := q.(*qcow2).header
+	h.io().WriteUint64(l2Entry, noCow|1<<40)
+
+	res, err := q.Check(RepairAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Clean() || res.CorruptionsFixed == 0 {
+		t.Fatalf("%+v", res)
+	}
+
+	// The first cluster is lost, and its old data cluster is freed
+	if h.io().ReadUint64(l2Entry) != 0 {
+		t.Fatal("Invalid entry wasn't dropped")
+	}
+	copy(data, make([]byte, h.clusterSize()))
+	requireClean(t, q)
+	verifyGuest(t, q, data)
+}
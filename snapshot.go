@@ -38,6 +38,8 @@ type snapshotHeader struct {
 
 type snapshotImpl struct {
 	header header
+	// Where in the file this snapshot's table entry is
+	entryOffset int64
 
 	l1Position   int64
 	l1Entries    int
@@ -85,17 +87,30 @@ func (s *snapshotImpl) GuestUptime() int64 {
 }
 
 func readSnapshots(h header) []Snapshot {
-	snaps := make([]Snapshot, 0)
+	table, _ := readSnapshotTable(h)
+	snaps := make([]Snapshot, 0, len(table))
+	for _, s := range table {
+		snaps = append(snaps, s)
+	}
+	return snaps
+}
+
+// Read the snapshot table, returning the snapshots and the size of the table in bytes
+func readSnapshotTable(h header) ([]*snapshotImpl, int64) {
+	snaps := make([]*snapshotImpl, 0)
 	if h.snapshotsOffset() == 0 {
-		return snaps
+		return snaps, 0
 	}
 
 	off := h.snapshotsOffset()
 	r := eio.NewReaderSection(h.io(), off, math.MaxInt64-off)
 	for i := 0; i < int(h.snapshotsCount()); i++ {
-		snaps = append(snaps, readSnapshot(h, r))
+		pos := off + r.Position()
+		snap := readSnapshot(h, r)
+		snap.entryOffset = pos
+		snaps = append(snaps, snap)
 	}
-	return snaps
+	return snaps, r.Position()
 }
 
 func readSnapshot(h header, r *eio.SequentialReader) *snapshotImpl {
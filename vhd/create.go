@@ -0,0 +1,147 @@
+package vhd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// CreateOptions describe a new VHD image
+type CreateOptions struct {
+	// The size of the disk in bytes. It's rounded up to a whole sector.
+	Size int64
+	// Fixed or Dynamic. Defaults to Dynamic.
+	Type DiskType
+	// The block size of a dynamic disk, a power of two. Defaults to 2 MB.
+	BlockSize uint32
+}
+
+const (
+	defaultBlockSize = 2 << 20
+	dynamicOffset    = footerSize
+	tableOffset      = dynamicOffset + 1024
+)
+
+// VHD timestamps count from the start of 2000
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Calculate the CHS geometry for a size, as described in the VHD spec
+func geometry(size int64) (cylinders uint16, heads uint8, sectors uint8) {
+	total := size / sectorSize
+	if total > 65535*16*255 {
+		total = 65535 * 16 * 255
+	}
+
+	var spt, h, cth int64
+	if total >= 65535*16*63 {
+		spt, h = 255, 16
+		cth = total / spt
+	} else {
+		spt = 17
+		cth = total / spt
+		h = (cth + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+		if cth >= h*1024 || h > 16 {
+			spt, h = 31, 16
+			cth = total / spt
+		}
+		if cth >= h*1024 {
+			spt, h = 63, 16
+			cth = total / spt
+		}
+	}
+	return uint16(cth / h), uint8(h), uint8(spt)
+}
+
+// Make a footer for a new image
+func newFooter(size int64, t DiskType) footer {
+	f := footer{
+		Features:          featureAlways,
+		FileFormatVersion: formatVersion,
+		DataOffset:        noOffset,
+		TimeStamp:         uint32(time.Since(epoch) / time.Second),
+		CreatorVersion:    formatVersion,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          t,
+	}
+	copy(f.Cookie[:], footerCookie)
+	copy(f.CreatorApplication[:], "qcow")
+	copy(f.CreatorHostOS[:], "Wi2k")
+	f.Cylinders, f.Heads, f.SectorsPerTrack = geometry(size)
+	_, err := rand.Read(f.UniqueID[:])
+	exc.ThrowOnError(err)
+	return f
+}
+
+// Write a new, empty image
+func create(rw eio.ReaderWriterAt, opts CreateOptions) *diskImpl {
+	if opts.Size < 0 {
+		exc.Throwf("Negative disk size %d", opts.Size)
+	}
+	if opts.Type == 0 {
+		opts.Type = Dynamic
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = defaultBlockSize
+	}
+	bs := opts.BlockSize
+	if bs < sectorSize || bs&(bs-1) != 0 {
+		exc.Throwf("Invalid VHD block size %d", bs)
+	}
+
+	size := eio.DivCeil(opts.Size, sectorSize) * sectorSize
+	d := &diskImpl{bio: eio.NewIO(rw, binary.BigEndian)}
+	d.footer = newFooter(size, opts.Type)
+
+	switch opts.Type {
+	case Fixed:
+		d.footerOffset = size
+	case Dynamic:
+		d.footer.DataOffset = dynamicOffset
+		entries := eio.DivCeil(size, int64(bs))
+		tableBytes := eio.DivCeil(entries*4, sectorSize) * sectorSize
+
+		d.dynamic = dynamicHeader{
+			DataOffset:      noOffset,
+			TableOffset:     tableOffset,
+			HeaderVersion:   formatVersion,
+			MaxTableEntries: uint32(entries),
+			BlockSize:       bs,
+		}
+		copy(d.dynamic.Cookie[:], dynamicCookie)
+		d.dynamic.Checksum = checksum(d.dynamic, 0)
+
+		// Copy of the footer, dynamic header and an empty table
+		d.footerOffset = tableOffset + tableBytes
+		d.footer.Checksum = checksum(d.footer, 0)
+		w := eio.NewSequentialWriter(d.bio, 0)
+		w.WriteData(d.footer)
+		w.WriteData(d.dynamic)
+		table := make([]byte, tableBytes)
+		for i := range table {
+			table[i] = 0xff
+		}
+		w.WriteBuf(table)
+		w.Commit()
+	default:
+		exc.Throwf("Can't create VHD disk type %d", opts.Type)
+	}
+
+	d.writeFooter()
+	d.open(rw)
+	return d
+}
+
+// Create a new VHD image, with an empty disk
+func Create(rw eio.ReaderWriterAt, opts CreateOptions) (disk Disk, err error) {
+	err = eio.BacktraceWrap(func() {
+		disk = create(rw, opts)
+	})
+	return
+}
@@ -0,0 +1,382 @@
+// Package vhd reads and writes VHD (Virtual PC) disk images.
+//
+// Fixed and dynamic disks are supported. Differencing disks are not.
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// Disk is the data of a VHD image
+type Disk interface {
+	io.Closer
+
+	// Read and write at positions
+	eio.ReaderWriterAt
+	// Get the size of this disk
+	Size() int64
+	// Sync the file if possible, so everything written so far is on stable
+	// storage
+	Flush() error
+}
+
+// DiskType is the kind of VHD image
+type DiskType uint32
+
+const (
+	// Fixed disks store all their data, followed by a footer
+	Fixed DiskType = 2
+	// Dynamic disks only store the blocks that are used
+	Dynamic DiskType = 3
+	// Differencing disks store changes to a parent disk
+	Differencing DiskType = 4
+)
+
+const (
+	footerCookie  = "conectix"
+	dynamicCookie = "cxsparse"
+	sectorSize    = 512
+	footerSize    = 512
+
+	formatVersion uint32 = 0x00010000
+	featureAlways uint32 = 2
+	noOffset      uint64 = ^uint64(0)
+	unusedBlock   uint32 = ^uint32(0)
+)
+
+// The footer at the end of every VHD image
+type footer struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           DiskType
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// The header of a dynamic disk
+type dynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    [16]byte
+	ParentTimeStamp   uint32
+	Reserved1         uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [8][24]byte
+	Reserved2         [256]byte
+}
+
+// Calculate a VHD checksum, the ones' complement of the sum of all bytes
+// except for the checksum itself
+func checksum(data interface{}, sum uint32) uint32 {
+	var buf bytes.Buffer
+	exc.ThrowOnError(binary.Write(&buf, binary.BigEndian, data))
+	var total uint32
+	for _, b := range buf.Bytes() {
+		total += uint32(b)
+	}
+	for i := uint(0); i < 32; i += 8 {
+		total -= (sum >> i) & 0xff
+	}
+	return ^total
+}
+
+type diskImpl struct {
+	bio     *eio.BinaryIO
+	footer  footer
+	dynamic dynamicHeader
+
+	// The block allocation table, for dynamic disks
+	bat []uint32
+	// Where the footer goes, which is also where new blocks go
+	footerOffset int64
+
+	// Guards the BAT and block bitmaps, for dynamic disks
+	sync.RWMutex
+}
+
+func (d *diskImpl) Size() int64 {
+	return int64(d.footer.CurrentSize)
+}
+
+func (d *diskImpl) Close() error {
+	return nil
+}
+
+func (d *diskImpl) Flush() error {
+	return eio.BacktraceWrap(func() {
+		d.bio.Sync()
+	})
+}
+
+// Read and validate a footer
+func (d *diskImpl) readFooter(off int64) bool {
+	d.bio.ReadData(off, &d.footer)
+	return string(d.footer.Cookie[:]) == footerCookie &&
+		checksum(d.footer, d.footer.Checksum) == d.footer.Checksum
+}
+
+func (d *diskImpl) open(rw eio.ReaderWriterAt) {
+	d.bio = eio.NewIO(rw, binary.BigEndian)
+
+	size, ok := d.bio.Size()
+	if ok && size >= footerSize && d.readFooter(size-footerSize) {
+		d.footerOffset = size - footerSize
+	} else if !d.readFooter(0) {
+		// Dynamic disks have a copy of the footer at the start
+		exc.Throwf("Not a VHD file")
+	} else if ok {
+		d.footerOffset = size - footerSize
+	} else {
+		d.footerOffset = -1 // Find it later
+	}
+
+	switch d.footer.DiskType {
+	case Fixed:
+		if d.footerOffset < 0 {
+			exc.Throwf("Can't find the end of a fixed VHD")
+		}
+		if d.footerOffset < d.Size() {
+			exc.Throwf("Fixed VHD is too small")
+		}
+	case Dynamic:
+		d.openDynamic()
+	case Differencing:
+		exc.Throwf("Differencing VHDs are not supported")
+	default:
+		exc.Throwf("Unknown VHD disk type %d", d.footer.DiskType)
+	}
+}
+
+// Read the extra structures of a dynamic disk
+func (d *diskImpl) openDynamic() {
+	d.bio.ReadData(int64(d.footer.DataOffset), &d.dynamic)
+	if string(d.dynamic.Cookie[:]) != dynamicCookie {
+		exc.Throwf("Missing VHD dynamic disk header")
+	}
+	if checksum(d.dynamic, d.dynamic.Checksum) != d.dynamic.Checksum {
+		exc.Throwf("Bad VHD dynamic disk header checksum")
+	}
+	bs := d.dynamic.BlockSize
+	if bs < sectorSize || bs&(bs-1) != 0 {
+		exc.Throwf("Invalid VHD block size %d", bs)
+	}
+	if int64(d.dynamic.MaxTableEntries)*int64(bs) < d.Size() {
+		exc.Throwf("VHD block allocation table is too small")
+	}
+
+	d.bat = make([]uint32, d.dynamic.MaxTableEntries)
+	d.bio.ReadData(int64(d.dynamic.TableOffset), d.bat)
+
+	if d.footerOffset < 0 {
+		// Put the footer after everything
+		d.footerOffset = int64(d.dynamic.TableOffset) +
+			eio.DivCeil(int64(len(d.bat))*4, sectorSize)*sectorSize
+		for _, b := range d.bat {
+			if b == unusedBlock {
+				continue
+			}
+			if end := int64(b)*sectorSize + d.blockBytes(); end > d.footerOffset {
+				d.footerOffset = end
+			}
+		}
+	}
+}
+
+// How big is a block's sector bitmap, in bytes?
+func (d *diskImpl) bitmapBytes() int64 {
+	sectors := int64(d.dynamic.BlockSize) / sectorSize
+	return eio.DivCeil(eio.DivCeil(sectors, 8), sectorSize) * sectorSize
+}
+
+// How much space does a block use, including the bitmap?
+func (d *diskImpl) blockBytes() int64 {
+	return d.bitmapBytes() + int64(d.dynamic.BlockSize)
+}
+
+// How much data is handled at once? For fixed disks, this is arbitrary.
+func (d *diskImpl) chunkSize() int64 {
+	if d.footer.DiskType == Fixed {
+		return 1 << 20
+	}
+	return int64(d.dynamic.BlockSize)
+}
+
+// Read part of a block
+func (d *diskImpl) readBlock(p []byte, block int64, off int64) {
+	if d.footer.DiskType == Fixed {
+		d.bio.ReadAt(block*d.chunkSize()+off, p)
+		return
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	entry := d.bat[block]
+	if entry == unusedBlock {
+		eio.ZeroFill(p)
+		return
+	}
+	start := int64(entry) * sectorSize
+	bitmap := make([]byte, d.bitmapBytes())
+	d.bio.ReadAt(start, bitmap)
+
+	// Read runs of sectors with the same presence
+	for len(p) > 0 {
+		sector := off / sectorSize
+		present := bitmap[sector/8]&(0x80>>uint(sector%8)) != 0
+		n := sectorSize - off%sectorSize
+		for next := sector + 1; n < int64(len(p)); next++ {
+			if (bitmap[next/8]&(0x80>>uint(next%8)) != 0) != present {
+				break
+			}
+			n += sectorSize
+		}
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+
+		if present {
+			d.bio.ReadAt(start+d.bitmapBytes()+off, p[:n])
+		} else {
+			eio.ZeroFill(p[:n])
+		}
+		p = p[n:]
+		off += n
+	}
+}
+
+// Write part of a block
+func (d *diskImpl) writeBlock(p []byte, block int64, off int64) {
+	if d.footer.DiskType == Fixed {
+		d.bio.WriteAt(block*d.chunkSize()+off, p)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	entry := d.bat[block]
+	if entry == unusedBlock {
+		if eio.IsZero(p) {
+			return // Already reads as zero
+		}
+		entry = d.allocate(block)
+	}
+
+	// Mark the sectors present
+	start := int64(entry) * sectorSize
+	first, last := off/sectorSize, (off+int64(len(p))-1)/sectorSize
+	bitmap := make([]byte, last/8-first/8+1)
+	d.bio.ReadAt(start+first/8, bitmap)
+	for s := first; s <= last; s++ {
+		bit := byte(0x80 >> uint(s%8))
+		if bitmap[s/8-first/8]&bit == 0 && (s == first || s == last) {
+			// Sectors that weren't present may hold junk
+			d.bio.Zero(start+d.bitmapBytes()+s*sectorSize, sectorSize)
+		}
+		bitmap[s/8-first/8] |= bit
+	}
+	d.bio.WriteAt(start+d.bitmapBytes()+off, p)
+	d.bio.WriteAt(start+first/8, bitmap)
+}
+
+// Allocate a new block at the end of the file, returning its BAT entry.
+//
+// Must hold the lock.
+func (d *diskImpl) allocate(block int64) uint32 {
+	start := d.footerOffset
+	if start%sectorSize != 0 {
+		exc.Throwf("Misaligned VHD footer")
+	}
+
+	// Zero the block, with no sectors present, then move the footer after it
+	d.bio.Zero(start, int(d.blockBytes()))
+	d.footerOffset += d.blockBytes()
+	d.writeFooter()
+
+	entry := uint32(start / sectorSize)
+	d.bat[block] = entry
+	d.bio.WriteUint32(int64(d.dynamic.TableOffset)+block*4, entry)
+	return entry
+}
+
+// Write the footer at the end of the file
+func (d *diskImpl) writeFooter() {
+	d.footer.Checksum = checksum(d.footer, d.footer.Checksum)
+	w := eio.NewSequentialWriter(d.bio, d.footerOffset)
+	w.WriteData(d.footer)
+	w.Commit()
+}
+
+// A function to process part of a block
+type blockFunc func(d *diskImpl, p []byte, block int64, off int64)
+
+// Break an operation down into single-block operations
+func (d *diskImpl) perBlock(p []byte, off int64, f blockFunc) int {
+	if off < 0 || off+int64(len(p)) > d.Size() {
+		exc.ThrowOnError(io.ErrUnexpectedEOF)
+	}
+
+	bs := d.chunkSize()
+	n := 0
+	for len(p) > 0 {
+		block, boff := off/bs, off%bs
+		length := bs - boff
+		if length > int64(len(p)) {
+			length = int64(len(p))
+		}
+		f(d, p[:length], block, boff)
+		p = p[length:]
+		off += length
+		n += int(length)
+	}
+	return n
+}
+
+func (d *diskImpl) ReadAt(p []byte, off int64) (n int, err error) {
+	err = eio.BacktraceWrap(func() {
+		n = d.perBlock(p, off, (*diskImpl).readBlock)
+	})
+	return
+}
+
+func (d *diskImpl) WriteAt(p []byte, off int64) (n int, err error) {
+	err = eio.BacktraceWrap(func() {
+		n = d.perBlock(p, off, (*diskImpl).writeBlock)
+	})
+	return
+}
+
+// Open a VHD image
+func Open(rw eio.ReaderWriterAt) (disk Disk, err error) {
+	err = eio.BacktraceWrap(func() {
+		d := &diskImpl{}
+		d.open(rw)
+		disk = d
+	})
+	return
+}
@@ -0,0 +1,163 @@
+package vhd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/vasi/qcow2/eio"
+)
+
+// Make an anonymous temporary file
+func tempFile(tb testing.TB) *os.File {
+	f, err := ioutil.TempFile("", "vhd-test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	os.Remove(f.Name())
+	return f
+}
+
+// Hides the size of a file
+type unsized struct {
+	eio.ReaderWriterAt
+}
+
+// Do some random writes, and update the expected data
+func writeRandom(tb testing.TB, d Disk, data []byte, seed int64) {
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < 100; i++ {
+		off := rnd.Int63n(d.Size())
+		length := rnd.Int63n(20000) + 1
+		if off+length > d.Size() {
+			length = d.Size() - off
+		}
+		p := data[off : off+length]
+		rnd.Read(p)
+		if _, err := d.WriteAt(p, off); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// Open a disk, and check its contents
+func verifyDisk(tb testing.TB, rw eio.ReaderWriterAt, data []byte) Disk {
+	d, err := Open(rw)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if d.Size() != int64(len(data)) {
+		tb.Fatalf("Size %d", d.Size())
+	}
+	got := make([]byte, len(data))
+	if _, err := d.ReadAt(got, 0); err != nil {
+		tb.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		tb.Fatal("Data doesn't match")
+	}
+	return d
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, opts := range []CreateOptions{
+		{Size: 1<<20 + 100, Type: Fixed},
+		{Size: 1<<20 + 100, BlockSize: 4096},
+		{Size: 5 << 20},
+	} {
+		f := tempFile(t)
+		d, err := Create(f, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, d.Size())
+		if len(data)%sectorSize != 0 || int64(len(data)) < opts.Size {
+			t.Fatalf("Size %d wasn't rounded up to a sector", len(data))
+		}
+		writeRandom(t, d, data, 1)
+		d.Close()
+
+		d = verifyDisk(t, f, data)
+		if _, err := d.ReadAt(make([]byte, 2), d.Size()-1); err == nil {
+			t.Fatal("Read past the end of the disk")
+		}
+		fi, _ := f.Stat()
+		if opts.Type == Fixed && fi.Size() != d.Size()+footerSize {
+			t.Fatalf("Fixed disk has file size %d", fi.Size())
+		}
+	}
+}
+
+func TestDynamicSparse(t *testing.T) {
+	f := tempFile(t)
+	d, err := Create(f, CreateOptions{Size: 64 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := f.Stat()
+	empty := fi.Size()
+
+	// Zeros don't allocate a block, data allocates just one
+	if _, err := d.WriteAt(make([]byte, 1<<20), 0); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ = f.Stat(); fi.Size() != empty {
+		t.Fatal("Writing zeros allocated a block")
+	}
+	if _, err := d.WriteAt([]byte{1}, 10<<20); err != nil {
+		t.Fatal(err)
+	}
+	di := d.(*diskImpl)
+	if fi, _ = f.Stat(); fi.Size() != empty+di.blockBytes() {
+		t.Fatalf("File grew from %d to %d", empty, fi.Size())
+	}
+}
+
+func TestDynamicJunk(t *testing.T) {
+	f := tempFile(t)
+	d, err := Create(f, CreateOptions{Size: 1 << 20, BlockSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.WriteAt([]byte{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Put junk in a sector that isn't present, then write part of it
+	di := d.(*diskImpl)
+	sector := int64(di.bat[0])*sectorSize + di.bitmapBytes() + 2*sectorSize
+	di.bio.WriteAt(sector, bytes.Repeat([]byte{0xff}, sectorSize))
+	if _, err := d.WriteAt([]byte{2}, 2*sectorSize+10); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, d.Size())
+	data[0], data[2*sectorSize+10] = 1, 2
+	verifyDisk(t, f, data)
+}
+
+func TestOpenUnsized(t *testing.T) {
+	f := tempFile(t)
+	d, err := Create(f, CreateOptions{Size: 1 << 20, BlockSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, d.Size())
+	writeRandom(t, d, data, 1)
+
+	// Without the file size, the footer copy at the start is used, and new
+	// blocks still go at the end
+	d = verifyDisk(t, unsized{f}, data)
+	writeRandom(t, d, data, 2)
+	verifyDisk(t, f, data)
+
+	f = tempFile(t)
+	if _, err := Create(f, CreateOptions{Size: 1 << 20, Type: Fixed}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(unsized{f}); err == nil {
+		t.Fatal("Opened a fixed disk without its size")
+	}
+}
@@ -0,0 +1,123 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// CreateOptions describe a new VMDK image
+type CreateOptions struct {
+	// The size of the disk in bytes. It's rounded up to a whole sector.
+	Size int64
+	// The file name to record in the descriptor. Defaults to "disk.vmdk".
+	Name string
+}
+
+const (
+	defaultGrainSize    = 128 // Sectors, for 64 KB grains
+	defaultGTEsPerGT    = 512
+	descriptorSectors   = 20
+	defaultName         = "disk.vmdk"
+	geometryHeads       = 16
+	geometrySectors     = 63
+	maxGeometryCylinder = 16383
+)
+
+// Make the text descriptor for a new image
+func descriptor(capacity int64, name string) []byte {
+	cylinders := capacity / (geometryHeads * geometrySectors)
+	if cylinders > maxGeometryCylinder {
+		cylinders = maxGeometryCylinder
+	}
+	text := fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "%d"
+ddb.geometry.sectors = "%d"
+ddb.adapterType = "ide"
+`, capacity, name, cylinders, geometryHeads, geometrySectors)
+
+	if len(text) > descriptorSectors*sectorSize {
+		exc.Throwf("VMDK descriptor too large")
+	}
+	return []byte(text)
+}
+
+// Write a new, empty monolithicSparse image
+func create(rw eio.ReaderWriterAt, opts CreateOptions) *diskImpl {
+	if opts.Size < 0 {
+		exc.Throwf("Negative disk size %d", opts.Size)
+	}
+	if opts.Name == "" {
+		opts.Name = defaultName
+	}
+
+	capacity := eio.DivCeil(opts.Size, sectorSize)
+	h := sparseHeader{
+		Magic:              magic,
+		Version:            1,
+		Flags:              flagNewlineTest | flagRedundantGrain,
+		Capacity:           uint64(capacity),
+		GrainSize:          defaultGrainSize,
+		DescriptorOffset:   1,
+		DescriptorSize:     descriptorSectors,
+		NumGTEsPerGT:       defaultGTEsPerGT,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+
+	// Two grain directories, each followed by all its grain tables
+	tables := eio.DivCeil(capacity, defaultGrainSize*defaultGTEsPerGT)
+	dirSectors := eio.DivCeil(tables*4, sectorSize)
+	gtSectors := int64(defaultGTEsPerGT * 4 / sectorSize)
+	metaSectors := dirSectors + tables*gtSectors
+	h.RGDOffset = uint64(1 + descriptorSectors)
+	h.GDOffset = h.RGDOffset + uint64(metaSectors)
+	h.OverHead = uint64(eio.DivCeil(int64(h.GDOffset)+metaSectors, defaultGrainSize) *
+		defaultGrainSize)
+
+	bio := eio.NewIO(rw, binary.LittleEndian)
+	bio.Zero(0, int(h.OverHead)*sectorSize)
+	w := eio.NewSequentialWriter(bio, 0)
+	w.WriteData(h)
+	w.WriteBuf(descriptor(capacity, opts.Name))
+	w.Commit()
+
+	for _, dir := range []uint64{h.RGDOffset, h.GDOffset} {
+		entries := make([]uint32, tables)
+		for i := range entries {
+			entries[i] = uint32(int64(dir) + dirSectors + int64(i)*gtSectors)
+		}
+		w = eio.NewSequentialWriter(bio, int64(dir)*sectorSize)
+		w.WriteData(entries)
+		w.Commit()
+	}
+
+	d := &diskImpl{}
+	d.open(rw)
+	return d
+}
+
+// Create a new monolithicSparse VMDK image, with an empty disk
+func Create(rw eio.ReaderWriterAt, opts CreateOptions) (disk Disk, err error) {
+	err = eio.BacktraceWrap(func() {
+		disk = create(rw, opts)
+	})
+	return
+}
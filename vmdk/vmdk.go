@@ -0,0 +1,363 @@
+// Package vmdk reads and writes VMware VMDK disk images.
+//
+// Hosted sparse extents are supported, in the monolithicSparse and
+// streamOptimized variants. Only monolithicSparse images can be written.
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/timtadh/data-structures/exc"
+	"github.com/vasi/qcow2/eio"
+)
+
+// Disk is the data of a VMDK image
+type Disk interface {
+	io.Closer
+
+	// Read and write at positions
+	eio.ReaderWriterAt
+	// Get the size of this disk
+	Size() int64
+	// Sync the file if possible, so everything written so far is on stable
+	// storage
+	Flush() error
+}
+
+const (
+	magic      uint32 = 0x564d444b // "KDMV"
+	sectorSize        = 512
+
+	flagNewlineTest    uint32 = 1
+	flagRedundantGrain uint32 = 2
+	flagCompressed     uint32 = 1 << 16
+	flagMarkers        uint32 = 1 << 17
+
+	compressionDeflate uint16 = 1
+
+	// The grain directory is in the footer
+	gdAtEnd uint64 = ^uint64(0)
+
+	// A grain table entry for a grain that reads as zeros
+	gteZero uint32 = 1
+)
+
+// The header of a sparse extent
+type sparseHeader struct {
+	Magic              uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64 // Sectors
+	GrainSize          uint64 // Sectors
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+// The start of a compressed grain
+type grainMarker struct {
+	LBA  uint64
+	Size uint32
+}
+
+const grainMarkerSize = 12
+
+type diskImpl struct {
+	bio    *eio.BinaryIO
+	header sparseHeader
+
+	// Sector offsets of grain tables, in each grain directory
+	directories [][]uint32
+	// The next free sector, for new grains
+	next int64
+
+	// Guards the grain tables and allocation, for writable disks
+	sync.RWMutex
+}
+
+// How many bytes in a grain?
+func (d *diskImpl) grainBytes() int64 {
+	return int64(d.header.GrainSize) * sectorSize
+}
+
+func (d *diskImpl) compressed() bool {
+	return d.header.Flags&flagCompressed != 0
+}
+
+func (d *diskImpl) Size() int64 {
+	return int64(d.header.Capacity) * sectorSize
+}
+
+func (d *diskImpl) Close() error {
+	return nil
+}
+
+func (d *diskImpl) Flush() error {
+	return eio.BacktraceWrap(func() {
+		d.bio.Sync()
+	})
+}
+
+func (d *diskImpl) open(rw eio.ReaderWriterAt) {
+	d.bio = eio.NewIO(rw, binary.LittleEndian)
+
+	var m [4]byte
+	d.bio.ReadAt(0, m[:])
+	if string(m[:]) == "# Di" {
+		exc.Throwf("VMDK descriptor files are not supported, only monolithic sparse images")
+	}
+	d.bio.ReadData(0, &d.header)
+	if d.header.Magic != magic {
+		exc.Throwf("Not a VMDK file")
+	}
+
+	if d.header.GDOffset == gdAtEnd {
+		// Stream-optimized, the real header is in the footer
+		size, ok := d.bio.Size()
+		if !ok {
+			exc.Throwf("Can't find VMDK footer without the file size")
+		}
+		d.bio.ReadData(size-2*sectorSize, &d.header)
+		if d.header.Magic != magic || d.header.GDOffset == gdAtEnd {
+			exc.Throwf("Invalid VMDK footer")
+		}
+	}
+	d.validate()
+
+	// Read the grain directories
+	offsets := []uint64{d.header.GDOffset}
+	if d.header.Flags&flagRedundantGrain != 0 && d.header.RGDOffset != 0 {
+		offsets = append(offsets, d.header.RGDOffset)
+	}
+	entries := eio.DivCeil(int64(d.header.Capacity), int64(d.header.GrainSize)*
+		int64(d.header.NumGTEsPerGT))
+	for _, off := range offsets {
+		dir := make([]uint32, entries)
+		d.bio.ReadData(int64(off)*sectorSize, dir)
+		d.directories = append(d.directories, dir)
+	}
+
+	if !d.compressed() {
+		d.findNext()
+	}
+}
+
+// Check that the header is usable
+func (d *diskImpl) validate() {
+	h := &d.header
+	if h.Version < 1 || h.Version > 3 {
+		exc.Throwf("Unsupported VMDK version %d", h.Version)
+	}
+	if h.GrainSize < 8 || h.GrainSize&(h.GrainSize-1) != 0 {
+		exc.Throwf("Invalid VMDK grain size %d", h.GrainSize)
+	}
+	if h.NumGTEsPerGT == 0 {
+		exc.Throwf("Invalid VMDK grain table size")
+	}
+	if h.GDOffset == 0 {
+		exc.Throwf("Missing VMDK grain directory")
+	}
+	if d.compressed() && h.CompressAlgorithm != compressionDeflate {
+		exc.Throwf("Unsupported VMDK compression algorithm %d", h.CompressAlgorithm)
+	}
+}
+
+// Find the first sector after all the data, where new grains can go
+func (d *diskImpl) findNext() {
+	if size, ok := d.bio.Size(); ok {
+		d.next = eio.DivCeil(size, sectorSize)
+		return
+	}
+
+	// Without a size, look at where everything is
+	d.next = int64(d.header.OverHead)
+	for _, gt := range d.directories[0] {
+		if gt == 0 {
+			continue
+		}
+		if end := int64(gt) + d.gtSectors(); end > d.next {
+			d.next = end
+		}
+		for _, gte := range d.readTable(gt) {
+			if gte > gteZero && int64(gte)+int64(d.header.GrainSize) > d.next {
+				d.next = int64(gte) + int64(d.header.GrainSize)
+			}
+		}
+	}
+}
+
+// How many sectors does a grain table use?
+func (d *diskImpl) gtSectors() int64 {
+	return eio.DivCeil(int64(d.header.NumGTEsPerGT)*4, sectorSize)
+}
+
+// Read a grain table
+func (d *diskImpl) readTable(gt uint32) []uint32 {
+	table := make([]uint32, d.header.NumGTEsPerGT)
+	d.bio.ReadData(int64(gt)*sectorSize, table)
+	return table
+}
+
+// Find where a grain table entry is, in each grain directory. Returns nil if
+// the grain table is missing.
+func (d *diskImpl) entryOffsets(grain int64) []int64 {
+	gdi := grain / int64(d.header.NumGTEsPerGT)
+	gti := grain % int64(d.header.NumGTEsPerGT)
+	if gdi >= int64(len(d.directories[0])) {
+		exc.Throwf("Grain %d out of range", grain)
+	}
+
+	offs := make([]int64, 0, len(d.directories))
+	for _, dir := range d.directories {
+		if dir[gdi] == 0 {
+			return nil
+		}
+		offs = append(offs, int64(dir[gdi])*sectorSize+gti*4)
+	}
+	return offs
+}
+
+// Get the grain table entry for a grain
+func (d *diskImpl) entry(grain int64) uint32 {
+	offs := d.entryOffsets(grain)
+	if offs == nil {
+		return 0
+	}
+	return d.bio.ReadUint32(offs[0])
+}
+
+// Read a compressed grain, given the sector where it starts
+func (d *diskImpl) readCompressed(sector uint32) []byte {
+	var m grainMarker
+	off := int64(sector) * sectorSize
+	d.bio.ReadData(off, &m)
+	z := make([]byte, m.Size)
+	d.bio.ReadAt(off+grainMarkerSize, z)
+
+	r, err := zlib.NewReader(bytes.NewReader(z))
+	exc.ThrowOnError(err)
+	defer r.Close()
+
+	// The last grain may be short
+	grain := make([]byte, d.grainBytes())
+	if _, err := io.ReadFull(r, grain); err != nil && err != io.ErrUnexpectedEOF {
+		exc.Throwf("Corrupt compressed grain: %v", err)
+	}
+	return grain
+}
+
+// Read part of a grain
+func (d *diskImpl) readGrain(p []byte, grain int64, off int64) {
+	// Compressed disks can't be written, so nothing changes under us
+	if !d.compressed() {
+		d.RLock()
+		defer d.RUnlock()
+	}
+
+	gte := d.entry(grain)
+	switch {
+	case gte <= gteZero:
+		eio.ZeroFill(p)
+	case d.compressed():
+		copy(p, d.readCompressed(gte)[off:])
+	default:
+		d.bio.ReadAt(int64(gte)*sectorSize+off, p)
+	}
+}
+
+// Write part of a grain
+func (d *diskImpl) writeGrain(p []byte, grain int64, off int64) {
+	if d.compressed() {
+		exc.Throwf("Can't write to a compressed VMDK")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	gte := d.entry(grain)
+	if gte > gteZero {
+		d.bio.WriteAt(int64(gte)*sectorSize+off, p)
+		return
+	}
+	if eio.IsZero(p) {
+		return // Already reads as zero
+	}
+
+	offs := d.entryOffsets(grain)
+	if offs == nil {
+		exc.Throwf("Missing VMDK grain table for grain %d", grain)
+	}
+
+	// Allocate a new grain at the end
+	buf := make([]byte, d.grainBytes())
+	copy(buf[off:], p)
+	sector := d.next
+	d.bio.WriteAt(sector*sectorSize, buf)
+	d.next += int64(d.header.GrainSize)
+	for _, o := range offs {
+		d.bio.WriteUint32(o, uint32(sector))
+	}
+}
+
+// A function to process part of a grain
+type grainFunc func(d *diskImpl, p []byte, grain int64, off int64)
+
+// Break an operation down into single-grain operations
+func (d *diskImpl) perGrain(p []byte, off int64, f grainFunc) int {
+	if off < 0 || off+int64(len(p)) > d.Size() {
+		exc.ThrowOnError(io.ErrUnexpectedEOF)
+	}
+
+	gb := d.grainBytes()
+	n := 0
+	for len(p) > 0 {
+		grain, goff := off/gb, off%gb
+		length := gb - goff
+		if length > int64(len(p)) {
+			length = int64(len(p))
+		}
+		f(d, p[:length], grain, goff)
+		p = p[length:]
+		off += length
+		n += int(length)
+	}
+	return n
+}
+
+func (d *diskImpl) ReadAt(p []byte, off int64) (n int, err error) {
+	err = eio.BacktraceWrap(func() {
+		n = d.perGrain(p, off, (*diskImpl).readGrain)
+	})
+	return
+}
+
+func (d *diskImpl) WriteAt(p []byte, off int64) (n int, err error) {
+	err = eio.BacktraceWrap(func() {
+		n = d.perGrain(p, off, (*diskImpl).writeGrain)
+	})
+	return
+}
+
+// Open a VMDK image. Compressed images are read-only.
+func Open(rw eio.ReaderWriterAt) (disk Disk, err error) {
+	err = eio.BacktraceWrap(func() {
+		d := &diskImpl{}
+		d.open(rw)
+		disk = d
+	})
+	return
+}
@@ -0,0 +1,223 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/vasi/qcow2/eio"
+)
+
+// Make an anonymous temporary file
+func tempFile(tb testing.TB) *os.File {
+	f, err := ioutil.TempFile("", "vmdk-test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	os.Remove(f.Name())
+	return f
+}
+
+func fileSize(tb testing.TB, f *os.File) int64 {
+	fi, err := f.Stat()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Big enough for several grain tables, and not a whole number of sectors
+	f := tempFile(t)
+	d, err := Create(f, CreateOptions{Size: 80<<20 + 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 80<<20+512 {
+		t.Fatalf("Size %d wasn't rounded up to a sector", d.Size())
+	}
+
+	// Write across grains and grain tables
+	data := make([]byte, d.Size())
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		off := rnd.Int63n(d.Size())
+		length := rnd.Int63n(200<<10) + 1
+		if off+length > d.Size() {
+			length = d.Size() - off
+		}
+		p := data[off : off+length]
+		rnd.Read(p)
+		if _, err := d.WriteAt(p, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Zeros aren't allocated
+	size := fileSize(t, f)
+	if _, err := d.WriteAt(make([]byte, 1<<16), 70<<20); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[70<<20:], make([]byte, 1<<16))
+	if fileSize(t, f) != size {
+		t.Fatal("Writing zeros allocated a grain")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, d.Size())
+	if _, err := d.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Data doesn't match")
+	}
+	if _, err := d.ReadAt(got[:2], d.Size()-1); err == nil {
+		t.Fatal("Read past the end of the disk")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	const workers = 8
+	d, err := Create(tempFile(t), CreateOptions{Size: 16 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each worker writes and reads back its own grains
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			p, got := make([]byte, 1000), make([]byte, 1000)
+			for i := 0; i < 200; i++ {
+				off := (rnd.Int63n(d.Size()/workers/(1<<16))*workers+int64(w))<<16 + 100
+				rnd.Read(p)
+				if _, err := d.WriteAt(p, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := d.ReadAt(got, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(got, p) {
+					t.Error("Data doesn't match")
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// Write a streamOptimized image with the given grains, with nil for grains
+// that aren't allocated
+func writeStream(f *os.File, grains [][]byte) {
+	const grainSize = 8
+	h := sparseHeader{
+		Magic:             magic,
+		Version:           3,
+		Flags:             flagNewlineTest | flagCompressed | flagMarkers,
+		Capacity:          uint64(len(grains) * grainSize),
+		GrainSize:         grainSize,
+		NumGTEsPerGT:      defaultGTEsPerGT,
+		GDOffset:          gdAtEnd,
+		DescriptorOffset:  1,
+		DescriptorSize:    1,
+		OverHead:          2,
+		CompressAlgorithm: compressionDeflate,
+	}
+	bio := eio.NewIO(f, binary.LittleEndian)
+	w := eio.NewSequentialWriter(bio, 0)
+	w.WriteData(h)
+	w.WriteBuf(make([]byte, sectorSize))
+
+	table := make([]uint32, defaultGTEsPerGT)
+	for i, g := range grains {
+		if g == nil {
+			continue
+		}
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(g)
+		zw.Close()
+		table[i] = uint32(w.Size() / sectorSize)
+		w.WriteData(grainMarker{LBA: uint64(i * grainSize), Size: uint32(z.Len())})
+		w.WriteBuf(z.Bytes())
+		w.Align(sectorSize)
+	}
+
+	gt := w.Size() / sectorSize
+	w.WriteData(table)
+	h.GDOffset = uint64(w.Size() / sectorSize)
+	w.WriteData(uint32(gt))
+	w.Align(sectorSize)
+
+	// The footer, then an end-of-stream marker
+	w.WriteData(h)
+	w.WriteBuf(make([]byte, sectorSize))
+	w.Commit()
+}
+
+func TestStreamOptimized(t *testing.T) {
+	grains := make([][]byte, 5)
+	for _, i := range []int{0, 1, 3} {
+		grains[i] = bytes.Repeat([]byte{byte(i + 1)}, 4096)
+	}
+	f := tempFile(t)
+	writeStream(f, grains)
+
+	d, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 5*4096 {
+		t.Fatalf("Size %d", d.Size())
+	}
+	got := make([]byte, d.Size())
+	if _, err := d.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range grains {
+		if g == nil {
+			g = make([]byte, 4096)
+		}
+		if !bytes.Equal(got[i*4096:(i+1)*4096], g) {
+			t.Fatalf("Grain %d doesn't match", i)
+		}
+	}
+
+	// Partial reads within a grain
+	p := make([]byte, 100)
+	if _, err := d.ReadAt(p, 4096+1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, grains[1][:100]) {
+		t.Fatal("Partial read doesn't match")
+	}
+
+	if _, err := d.WriteAt([]byte{1}, 0); err == nil {
+		t.Fatal("Wrote to a compressed image")
+	}
+}
+
+func TestOpenDescriptor(t *testing.T) {
+	f := tempFile(t)
+	f.WriteAt(descriptor(100, defaultName), 0)
+	if _, err := Open(f); err == nil {
+		t.Fatal("Opened a descriptor file")
+	}
+}
@@ -0,0 +1,88 @@
+package qcow2
+
+import "github.com/vasi/qcow2/eio"
+
+// Zero a whole cluster by changing its L2 entry.
+//
+// Returns false if this isn't possible, and zeros must be written instead.
+func (g *guestImpl) zeroCluster(idx int64, mayUnmap bool) bool {
+	lock := g.rangeLock(idx)
+	lock.Lock()
+	defer lock.Unlock()
+
+	old := g.getL2(idx, false)
+	if _, _, ok := g.hostClusters(old); !ok {
+		// Already unallocated or zero. Without a backing file, that reads as zero.
+		return true
+	}
+
+	var e mapEntry
+	keep := false
+	if g.header.version() >= 3 {
+		if !mayUnmap && !old.compressed() {
+			// Keep the allocation, as a preallocated zero cluster
+			e = old | mapEntry(zeroBit)
+			keep = true
+		} else {
+			e = mapEntry(zeroBit)
+		}
+	} else if mayUnmap {
+		e = 0
+	} else {
+		return false
+	}
+
+	if e == old {
+		return true
+	}
+	g.beginWrite()
+	g.setL2(idx, e)
+	if !keep {
+		g.freeEntry(old)
+	}
+	return true
+}
+
+// Write zero bytes to a range
+func (g *guestImpl) writeZeroBytes(off int64, length int64) {
+	if length <= 0 {
+		return
+	}
+	g.perL2(make([]byte, length), off, (*guestImpl).writeZeroRange)
+}
+
+func (g *guestImpl) WriteZeroes(off int64, length int64, mayUnmap bool) error {
+	if g.readOnly {
+		return errOpenedReadOnly
+	}
+	return eio.BacktraceWrap(func() {
+		cs := int64(g.clusterSize())
+		first, end := g.wholeClusters(off, length)
+		if first >= end {
+			g.writeZeroBytes(off, length)
+			return
+		}
+
+		// Partial clusters at the edges
+		g.writeZeroBytes(off, first*cs-off)
+		if end*cs < off+length {
+			g.writeZeroBytes(end*cs, off+length-end*cs)
+		}
+
+		for idx := first; idx < end; idx++ {
+			if !g.zeroCluster(idx, mayUnmap) {
+				clusterEnd := (idx + 1) * cs
+				if clusterEnd > g.size {
+					clusterEnd = g.size
+				}
+				g.writeZeroBytes(idx*cs, clusterEnd-idx*cs)
+			}
+		}
+	})
+}
+
+// Write zero bytes to a range within a single L2 table. Clusters that are
+// already zero are left alone, so they're not allocated.
+func (g *guestImpl) writeZeroRange(p []byte, idx int64, off int) {
+	g.writeRangeCompare(p, idx, off, true)
+}